@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// node-level aggregates computed over every GPU of a snapshot
+
+	aggregateMin    = "min"
+	aggregateMax    = "max"
+	aggregateSum    = "sum"
+	aggregateMean   = "mean"
+	aggregateStddev = "stddev"
+)
+
+var (
+	// aggregateGPUIDs are gpu_id label values of aggregate series,
+	// mean keeps gpu_avg for continuity with existing series
+	aggregateGPUIDs = map[string]string{
+		aggregateMin:    "gpu_min",
+		aggregateMax:    "gpu_max",
+		aggregateSum:    "gpu_sum",
+		aggregateMean:   "gpu_avg",
+		aggregateStddev: "gpu_stddev",
+	}
+)
+
+// aggregate computes an aggregate over values, values must not be empty
+func aggregate(name string, values []float64) float64 {
+	switch name {
+	case aggregateMin:
+		v := values[0]
+		for _, value := range values[1:] {
+			v = math.Min(v, value)
+		}
+		return v
+	case aggregateMax:
+		v := values[0]
+		for _, value := range values[1:] {
+			v = math.Max(v, value)
+		}
+		return v
+	case aggregateSum:
+		v := float64(0)
+		for _, value := range values {
+			v += value
+		}
+		return v
+	case aggregateMean:
+		return aggregate(aggregateSum, values) / float64(len(values))
+	case aggregateStddev:
+		mean := aggregate(aggregateMean, values)
+		v := float64(0)
+		for _, value := range values {
+			v += (value - mean) * (value - mean)
+		}
+		return math.Sqrt(v / float64(len(values)))
+	default:
+		return 0
+	}
+}
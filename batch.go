@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gax "github.com/googleapis/gax-go/v2"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxSeriesPerRequest is the Cloud Monitoring limit of time series
+	// written by one CreateTimeSeries request
+	maxSeriesPerRequest = 200
+
+	// maxWriteWorkers bounds concurrent CreateTimeSeries requests
+	maxWriteWorkers = 4
+
+	// writeTimeout bounds a CreateTimeSeries request and its retries
+	writeTimeout = time.Minute
+)
+
+var (
+	// retryableCodes are gRPC codes of transient Cloud Monitoring errors
+	retryableCodes = []codes.Code{
+		codes.Unavailable,
+		codes.DeadlineExceeded,
+		codes.ResourceExhausted,
+		codes.Aborted,
+		codes.Internal,
+	}
+
+	writeBackoff = gax.Backoff{
+		Initial:    time.Second,
+		Max:        16 * time.Second,
+		Multiplier: 2,
+	}
+)
+
+// chunks splits series in slices of at most size series
+func chunks(series []*monitoringpb.TimeSeries, size int) [][]*monitoringpb.TimeSeries {
+	var out [][]*monitoringpb.TimeSeries
+	for len(series) > size {
+		out = append(out, series[:size])
+		series = series[size:]
+	}
+
+	if len(series) > 0 {
+		out = append(out, series)
+	}
+
+	return out
+}
+
+// writeBatch writes points of a batch in requests of maxSeriesPerRequest
+// series, at most maxWriteWorkers requests run at once across batches.
+// Requests failing after retries are queued on disk if enabled, the whole
+// batch is queued while the queue isn't drained since points of a series
+// must be written in order, it returns an error if a request failed
+func (g *gcpSink) writeBatch(b *timeSeriesBatch) error {
+	series := make([]*monitoringpb.TimeSeries, 0, len(b.series))
+	for _, ts := range b.series {
+		series = append(series, g.timeSeries(ts))
+	}
+
+	if g.queue != nil && !g.queue.empty() {
+		for _, chunk := range chunks(series, maxSeriesPerRequest) {
+			g.enqueue(chunk, b.end)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+
+	requests := chunks(series, maxSeriesPerRequest)
+
+	for _, chunk := range requests {
+		wg.Add(1)
+		g.writers <- struct{}{}
+
+		go func(series []*monitoringpb.TimeSeries) {
+			defer wg.Done()
+			defer func() { <-g.writers }()
+
+			err := g.writeTimeSeries(series)
+			if err == nil {
+				return
+			}
+
+			atomic.AddInt32(&failed, 1)
+
+			if g.queue != nil && retryable(err) {
+				g.enqueue(series, b.end)
+			}
+		}(chunk)
+	}
+
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d/%d CreateTimeSeries requests failed", failed, len(requests))
+	}
+
+	return nil
+}
+
+// writeTimeSeries writes series in one request, retried with exponential
+// backoff on transient errors
+func (g *gcpSink) writeTimeSeries(series []*monitoringpb.TimeSeries) error {
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/" + g.projectID,
+		TimeSeries: series,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	err := g.client.CreateTimeSeries(ctx, req, gax.WithRetry(func() gax.Retryer {
+		return gax.OnCodes(retryableCodes, writeBackoff)
+	}))
+	if err != nil {
+		for _, msg := range writeErrors(err, len(series)) {
+			_ = g.slog.Err(msg)
+		}
+	}
+
+	return err
+}
+
+// retryable returns true if a failed request may succeed later,
+// errors without gRPC status come from the transport
+func retryable(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+
+	for _, c := range retryableCodes {
+		if st.Code() == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enqueue stores series on disk, to be written by drainQueue
+func (g *gcpSink) enqueue(series []*monitoringpb.TimeSeries, end time.Time) {
+	dropped, err := g.queue.push(series, end)
+	if err != nil {
+		_ = g.slog.Err(fmt.Sprintf("%d series lost: %s", len(series), err.Error()))
+		return
+	}
+
+	if dropped > 0 {
+		_ = g.slog.Warning(fmt.Sprintf("Queue full, %d oldest requests dropped", dropped))
+	}
+}
+
+// drainQueue writes queued series in timestamp order every interval,
+// it stops at the first transient failure to keep points in order, series
+// too old to be accepted are dropped
+func (g *gcpSink) drainQueue(interval time.Duration) {
+	for {
+		g.drainOnce()
+
+		time.Sleep(interval)
+	}
+}
+
+func (g *gcpSink) drainOnce() {
+	for {
+		name, series, err := g.queue.oldest()
+		if name == "" {
+			return
+		}
+
+		if err != nil {
+			_ = g.slog.Err(fmt.Sprintf("Queued request %s dropped: %s", name, err.Error()))
+			g.queue.remove(name)
+			continue
+		}
+
+		fresh := freshSeries(series, time.Now())
+		if len(fresh) < len(series) {
+			_ = g.slog.Warning(fmt.Sprintf("%d queued series older than %s dropped", len(series)-len(fresh), maxPointAge))
+		}
+
+		if len(fresh) > 0 {
+			g.writers <- struct{}{}
+			err = g.writeTimeSeries(fresh)
+			<-g.writers
+
+			if err != nil && retryable(err) {
+				return
+			}
+		}
+
+		g.queue.remove(name)
+	}
+}
+
+// writeErrors returns messages of a failed CreateTimeSeries request, a
+// partial failure is detailed by one message per rejection cause so a
+// single rejected series does not hide the others
+func writeErrors(err error, count int) []string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	for _, d := range st.Details() {
+		summary, ok := d.(*monitoringpb.CreateTimeSeriesSummary)
+		if !ok {
+			continue
+		}
+
+		msgs := []string{fmt.Sprintf("%d/%d points written: %s",
+			summary.SuccessPointCount, summary.TotalPointCount, st.Message())}
+		for _, e := range summary.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d points rejected: %s", e.PointCount, e.Status.GetMessage()))
+		}
+
+		return msgs
+	}
+
+	return []string{fmt.Sprintf("0/%d series written: %s", count, err.Error())}
+}
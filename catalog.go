@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// queryConfig is the representation of a nvidiasmiQuery in a metrics config file
+type queryConfig struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	Kind        string    `json:"kind"`
+	Type        string    `json:"value_type"`
+	Unit        string    `json:"unit"`
+	Scale       float64   `json:"scale"`
+	Parser      string    `json:"parser"`
+	Aggregates  []string  `json:"aggregates"`
+	Buckets     []float64 `json:"buckets"`
+}
+
+var (
+	// supported metric kinds and value types in a metrics config file
+
+	configKinds = map[string]metric.MetricDescriptor_MetricKind{
+		"GAUGE":      metric.MetricDescriptor_GAUGE,
+		"CUMULATIVE": metric.MetricDescriptor_CUMULATIVE,
+	}
+
+	configTypes = map[string]metric.MetricDescriptor_ValueType{
+		"INT64":  metric.MetricDescriptor_INT64,
+		"DOUBLE": metric.MetricDescriptor_DOUBLE,
+		"BOOL":   metric.MetricDescriptor_BOOL,
+	}
+
+	configParsers = map[string]bool{
+		parserNumber:  true,
+		parserPState:  true,
+		parserActive:  true,
+		parserBitmask: true,
+	}
+)
+
+// loadQueries reads a JSON metrics config file, it must contain an array of queries
+func loadQueries(path string) ([]nvidiasmiQuery, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []queryConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("%s - %s", path, err.Error())
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s - no query declared", path)
+	}
+
+	queries := make([]nvidiasmiQuery, 0, len(configs))
+
+	for _, c := range configs {
+		q, err := c.query()
+		if err != nil {
+			return nil, fmt.Errorf("%s - %s", path, err.Error())
+		}
+
+		queries = append(queries, q)
+	}
+
+	return queries, nil
+}
+
+// query converts a config entry into a nvidiasmiQuery, kind defaults
+// to GAUGE, value type to INT64 and display name to the query name
+func (c *queryConfig) query() (nvidiasmiQuery, error) {
+	if c.Name == "" {
+		return nvidiasmiQuery{}, errors.New("query without name")
+	}
+
+	q := nvidiasmiQuery{
+		Name:        c.Name,
+		DisplayName: c.DisplayName,
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        c.Unit,
+		Scale:       c.Scale,
+		Parser:      c.Parser,
+		Aggregates:  c.Aggregates,
+		Buckets:     c.Buckets,
+	}
+
+	if q.DisplayName == "" {
+		q.DisplayName = c.Name
+	}
+
+	if c.Kind != "" {
+		kind, ok := configKinds[c.Kind]
+		if !ok {
+			return nvidiasmiQuery{}, fmt.Errorf("%s - unsupported kind %q", c.Name, c.Kind)
+		}
+		q.Kind = kind
+	}
+
+	if c.Type != "" {
+		valueType, ok := configTypes[c.Type]
+		if !ok {
+			return nvidiasmiQuery{}, fmt.Errorf("%s - unsupported value type %q", c.Name, c.Type)
+		}
+		q.Type = valueType
+	}
+
+	if q.Kind == metric.MetricDescriptor_CUMULATIVE && q.Type == metric.MetricDescriptor_BOOL {
+		return nvidiasmiQuery{}, fmt.Errorf("%s - BOOL value type can't be CUMULATIVE", c.Name)
+	}
+
+	if !configParsers[c.Parser] {
+		return nvidiasmiQuery{}, fmt.Errorf("%s - unsupported parser %q", c.Name, c.Parser)
+	}
+
+	for i := 1; i < len(c.Buckets); i++ {
+		if c.Buckets[i] <= c.Buckets[i-1] {
+			return nvidiasmiQuery{}, fmt.Errorf("%s - buckets must be strictly increasing", c.Name)
+		}
+	}
+
+	for _, a := range c.Aggregates {
+		if err := validateAggregate(&q, a); err != nil {
+			return nvidiasmiQuery{}, fmt.Errorf("%s - %s", c.Name, err.Error())
+		}
+	}
+
+	return q, nil
+}
+
+// validateAggregate checks an aggregate is meaningful for the query,
+// booleans support min (all) and max (any), counters only support sum
+func validateAggregate(q *nvidiasmiQuery, a string) error {
+	if _, ok := aggregateGPUIDs[a]; !ok {
+		return fmt.Errorf("unsupported aggregate %q", a)
+	}
+
+	switch {
+	case q.Parser == parserBitmask:
+		return fmt.Errorf("aggregate %q not supported by bitmask values", a)
+	case q.Type == metric.MetricDescriptor_BOOL && a != aggregateMin && a != aggregateMax:
+		return fmt.Errorf("aggregate %q not supported by BOOL values", a)
+	case q.Kind == metric.MetricDescriptor_CUMULATIVE && a != aggregateSum:
+		return fmt.Errorf("aggregate %q not supported by CUMULATIVE metrics", a)
+	}
+
+	return nil
+}
+
+// validateQueries checks every query is unique and reported by the collector
+func validateQueries(queries []nvidiasmiQuery, supported []string) error {
+	fields := make(map[string]bool, len(supported))
+	for _, f := range supported {
+		fields[f] = true
+	}
+
+	seen := make(map[string]bool, len(queries))
+
+	for _, q := range queries {
+		if seen[q.Name] {
+			return fmt.Errorf("%s - query declared twice", q.Name)
+		}
+		seen[q.Name] = true
+
+		if !fields[q.Name] {
+			return fmt.Errorf("%s - query not supported by nvidia-smi", q.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/syslog"
+	"time"
+)
+
+// gpuSample represents every queried value of a single GPU,
+// all of them coming from the same collection, a query without
+// value means nvidia-smi didn't report it (N/A, not supported...)
+type gpuSample struct {
+	ID     int
+	BusID  string
+	Values map[string]float64
+}
+
+// gpuIdentity represents static attributes of a GPU which don't
+// change between reboots, unlike its index
+type gpuIdentity struct {
+	BusID  string
+	UUID   string
+	Serial string
+	Name   string
+}
+
+// processSample represents the GPU memory used by a compute process
+type processSample struct {
+	PID        int
+	Name       string
+	GPUUUID    string
+	UsedMemory float64
+}
+
+// Collector is implemented by every GPU metrics backend
+type Collector interface {
+	// GPUAmount returns the amount of GPUs available on the instance
+	GPUAmount() (int, error)
+	// Collect returns one sample per GPU holding a value for each query
+	Collect(queries []nvidiasmiQuery) ([]gpuSample, error)
+	// Identities returns static attributes of every GPU
+	Identities() ([]gpuIdentity, error)
+	// CollectProcesses returns one sample per running compute process and GPU
+	CollectProcesses() ([]processSample, error)
+	// CollectMIG returns MIG mode and MIG devices of the snapshot GPUs
+	CollectMIG(samples []gpuSample) ([]migGPU, error)
+	// SupportedQueries returns every query name the backend can collect
+	SupportedQueries() ([]string, error)
+}
+
+// newCollector returns the fake collector if a fixtures path is set,
+// the streaming nvidia-smi one if enabled, the per call nvidia-smi one otherwise
+func newCollector(slog *syslog.Writer) Collector {
+	if flagFakeFixturesPath != "" {
+		return &fakeCollector{fixturesPath: flagFakeFixturesPath}
+	}
+
+	if flagEnableNvidiasmiStream {
+		// stream at the sample interval when sampling is enabled
+		interval := time.Duration(flagFetchMetricsInterval) * time.Second
+		if flagSampleIntervalMs > 0 {
+			interval = time.Duration(flagSampleIntervalMs) * time.Millisecond
+		}
+
+		return newStreamCollector(interval, slog)
+	}
+
+	return &nvidiasmiCollector{}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cumulativeSeries is the state of a cumulative time series
+type cumulativeSeries struct {
+	labels  map[string]string
+	start   time.Time
+	lastEnd time.Time
+	last    float64
+}
+
+// cumulativeTracker keeps the start time of every cumulative time series,
+// a new start time is used when a counter goes backwards (e.g. driver reload)
+type cumulativeTracker struct {
+	mu     sync.Mutex
+	series map[string]*cumulativeSeries
+}
+
+func newCumulativeTracker() *cumulativeTracker {
+	return &cumulativeTracker{
+		series: make(map[string]*cumulativeSeries),
+	}
+}
+
+// startTime returns the start time of the series identified by metricType
+// and labels for a value read at end
+func (t *cumulativeTracker) startTime(metricType string, labels map[string]string, value float64, end time.Time) time.Time {
+	key := seriesKey(metricType, labels)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cs, ok := t.series[key]
+	switch {
+	case !ok:
+		// start time must be earlier than end time for cumulative metrics
+		cs = &cumulativeSeries{labels: labels, start: end.Add(-time.Millisecond)}
+		t.series[key] = cs
+	case value < cs.last:
+		// counter has been reset, new interval must not overlap the previous one
+		cs.start = cs.lastEnd.Add(time.Millisecond)
+	}
+
+	cs.last = value
+	cs.lastEnd = end
+
+	return cs.start
+}
+
+// forget drops every series having the given label value, their start time
+// will be set again if they come back
+func (t *cumulativeTracker) forget(key string, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, cs := range t.series {
+		if cs.labels[key] == value {
+			delete(t.series, k)
+		}
+	}
+}
+
+// seriesKey identifies a time series by its metric type and labels
+func seriesKey(metricType string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(metricType)
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + labels[k])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/iterator"
+	label "google.golang.org/genproto/googleapis/api/label"
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	metricDomainCustom   = "custom.googleapis.com"
+	metricDomainWorkload = "workload.googleapis.com"
+
+	// maxMetricTypeLength is the Cloud Monitoring limit of metric type names
+	maxMetricTypeLength = 200
+)
+
+var (
+	// metricPathRegexp matches the path of a metric type after its domain
+	metricPathRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+(/[a-zA-Z0-9_]+)*$`)
+)
+
+// descriptorChange is an existing descriptor which can't receive
+// points of the catalog anymore, or which lacks some of their labels
+type descriptorChange struct {
+	desired  *metric.MetricDescriptor
+	existing *metric.MetricDescriptor
+	reasons  []string
+}
+
+// descriptorDiff compares descriptors of the catalog with existing ones
+type descriptorDiff struct {
+	missing      []*metric.MetricDescriptor
+	labels       []descriptorChange
+	incompatible []descriptorChange
+	stale        []*metric.MetricDescriptor
+}
+
+func (d descriptorDiff) empty() bool {
+	return len(d.missing) == 0 && len(d.labels) == 0 && len(d.incompatible) == 0 && len(d.stale) == 0
+}
+
+// desiredDescriptors returns descriptors of every metric published with
+// the current catalog and flags
+func desiredDescriptors() []*metric.MetricDescriptor {
+	var modes []string
+	if flagSampleIntervalMs > 0 {
+		modes = []string{flagExportMode}
+	}
+
+	return catalogDescriptors(modes, flagXIDSource != xidSourceNone, flagEnableMIG)
+}
+
+// allDescriptors returns descriptors of every metric the catalog may
+// publish whatever the flags, other agents of the project may run with
+// sampling, XID errors or MIG enabled
+func allDescriptors() []*metric.MetricDescriptor {
+	return catalogDescriptors([]string{exportModeSummary, exportModeDistribution}, true, true)
+}
+
+// catalogDescriptors returns descriptors of the catalog, with high
+// frequency samples descriptors of export modes and optional families
+func catalogDescriptors(modes []string, xid bool, mig bool) []*metric.MetricDescriptor {
+	var descriptors []*metric.MetricDescriptor
+
+	for _, query := range nvidiasmiQueries {
+		q := query
+		descriptors = append(descriptors, metricDescriptor(&q, gpuLabels))
+
+		if !q.sampled() {
+			continue
+		}
+
+		// high frequency samples descriptors
+		for _, mode := range modes {
+			for _, sq := range sampledQueries(&q, mode) {
+				descriptors = append(descriptors, metricDescriptor(&sq, gpuLabels))
+			}
+		}
+	}
+
+	descriptors = append(descriptors,
+		metricDescriptor(&processMemoryQuery, processLabels),
+		metricDescriptor(&deviceCountQuery, nil),
+		metricDescriptor(&inventoryChangesQuery, inventoryLabels),
+		metricDescriptor(&collectorTimeoutsQuery, nil),
+	)
+
+	if xid {
+		descriptors = append(descriptors, metricDescriptor(&xidErrorsQuery, xidLabels))
+	}
+
+	if mig {
+		descriptors = append(descriptors,
+			metricDescriptor(&migEnabledQuery, gpuLabels),
+			metricDescriptor(&migMemoryUsedQuery, migLabels),
+			metricDescriptor(&migMemoryTotalQuery, migLabels),
+			metricDescriptor(&migMemoryUtilizationQuery, migLabels),
+		)
+	}
+
+	return descriptors
+}
+
+func metricDescriptor(q *nvidiasmiQuery, labelKeys []string) *metric.MetricDescriptor {
+	fquery := q.gcpFormat()
+
+	keys := append([]string{}, labelKeys...)
+	keys = append(keys, "instance_name")
+
+	labels := make([]*label.LabelDescriptor, 0, len(keys))
+	for _, key := range keys {
+		labels = append(labels, &label.LabelDescriptor{
+			Key:         key,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "related " + key + " for " + fquery + " metric",
+		})
+	}
+
+	return &metric.MetricDescriptor{
+		Name:        fquery,
+		DisplayName: q.DisplayName,
+		Type:        metricType(fquery),
+		MetricKind:  q.Kind,
+		ValueType:   q.Type,
+		Unit:        q.Unit,
+		Description: "gcp_gpu_metrics for " + fquery + " nvidia-smi query",
+		Labels:      labels,
+	}
+}
+
+// metricTypePrefix returns the prefix shared by every metric type,
+// made of the metric domain and path prefix
+func metricTypePrefix() string {
+	prefix := strings.Trim(flagMetricPrefix, "/")
+	if prefix == "" {
+		return flagMetricDomain + "/"
+	}
+
+	return flagMetricDomain + "/" + prefix + "/"
+}
+
+// ownMetricType returns true if a metric type is right under the prefix,
+// types under a longer prefix belong to another catalog, e.g. of
+// --metric-prefix gpu/teamb when the prefix is gpu
+func ownMetricType(t string) bool {
+	prefix := metricTypePrefix()
+
+	return strings.HasPrefix(t, prefix) && !strings.Contains(t[len(prefix):], "/")
+}
+
+// metricType returns the metric type of a query formatted by gcpFormat,
+// of both its descriptor and time series
+func metricType(fquery string) string {
+	return metricTypePrefix() + fquery
+}
+
+// validateMetricTypes checks the metric domain and that every metric type
+// of descriptors is a legal Cloud Monitoring type name
+func validateMetricTypes(descriptors []*metric.MetricDescriptor) error {
+	if flagMetricDomain != metricDomainCustom && flagMetricDomain != metricDomainWorkload {
+		return fmt.Errorf("unsupported metric domain %q, %q or %q expected", flagMetricDomain, metricDomainCustom, metricDomainWorkload)
+	}
+
+	for _, d := range descriptors {
+		path := strings.TrimPrefix(d.Type, flagMetricDomain+"/")
+		if !metricPathRegexp.MatchString(path) {
+			return fmt.Errorf("illegal metric type %q, path must be made of letters, digits and underscores separated by slashes", d.Type)
+		}
+
+		if len(d.Type) > maxMetricTypeLength {
+			return fmt.Errorf("illegal metric type %q, longer than %d characters", d.Type, maxMetricTypeLength)
+		}
+	}
+
+	return nil
+}
+
+// diffDescriptors compares desired descriptors with existing ones, a
+// descriptor lacking labels gets them added, it's incompatible if its kind
+// or value type differ and stale if the whole catalog doesn't have it
+func diffDescriptors(desired []*metric.MetricDescriptor, catalog []*metric.MetricDescriptor, existing []*metric.MetricDescriptor) descriptorDiff {
+	var diff descriptorDiff
+
+	byType := make(map[string]*metric.MetricDescriptor, len(existing))
+	for _, d := range existing {
+		byType[d.Type] = d
+	}
+
+	for _, d := range desired {
+		e, ok := byType[d.Type]
+		if !ok {
+			diff.missing = append(diff.missing, d)
+			continue
+		}
+
+		if reasons := incompatibilities(d, e); len(reasons) > 0 {
+			diff.incompatible = append(diff.incompatible, descriptorChange{desired: d, existing: e, reasons: reasons})
+			continue
+		}
+
+		if missing := missingLabels(d, e); len(missing) > 0 {
+			diff.labels = append(diff.labels, descriptorChange{
+				desired:  withExistingLabels(d, e),
+				existing: e,
+				reasons:  []string{"missing labels " + strings.Join(missing, ",")},
+			})
+		}
+	}
+
+	known := make(map[string]bool, len(catalog))
+	for _, d := range catalog {
+		known[d.Type] = true
+	}
+
+	for _, e := range existing {
+		if !known[e.Type] && ownMetricType(e.Type) {
+			diff.stale = append(diff.stale, e)
+		}
+	}
+
+	return diff
+}
+
+func incompatibilities(desired *metric.MetricDescriptor, existing *metric.MetricDescriptor) []string {
+	var reasons []string
+
+	if desired.MetricKind != existing.MetricKind {
+		reasons = append(reasons, fmt.Sprintf("kind %s, want %s", existing.MetricKind, desired.MetricKind))
+	}
+
+	if desired.ValueType != existing.ValueType {
+		reasons = append(reasons, fmt.Sprintf("value type %s, want %s", existing.ValueType, desired.ValueType))
+	}
+
+	return reasons
+}
+
+// missingLabels returns labels of desired unknown to existing, points can't
+// have them until they're added, unused labels of existing are harmless
+func missingLabels(desired *metric.MetricDescriptor, existing *metric.MetricDescriptor) []string {
+	keys := make(map[string]bool, len(existing.Labels))
+	for _, l := range existing.Labels {
+		keys[l.Key] = true
+	}
+
+	var missing []string
+	for _, l := range desired.Labels {
+		if !keys[l.Key] {
+			missing = append(missing, l.Key)
+		}
+	}
+
+	return missing
+}
+
+// withExistingLabels returns desired with labels of existing it lacks,
+// labels can be added to a descriptor but not removed
+func withExistingLabels(desired *metric.MetricDescriptor, existing *metric.MetricDescriptor) *metric.MetricDescriptor {
+	keys := make(map[string]bool, len(desired.Labels))
+	for _, l := range desired.Labels {
+		keys[l.Key] = true
+	}
+
+	d := proto.Clone(desired).(*metric.MetricDescriptor)
+	for _, l := range existing.Labels {
+		if !keys[l.Key] {
+			d.Labels = append(d.Labels, l)
+		}
+	}
+
+	return d
+}
+
+// addMetricDescriptorLabels creates a descriptor again with its new
+// labels, Cloud Monitoring keeps its data
+func (g *gcpSink) addMetricDescriptorLabels(c descriptorChange) error {
+	return g.createMetricDescriptor(c.desired)
+}
+
+// listMetricDescriptors returns existing descriptors under the metric type
+// prefix, including those of longer prefixes, see ownMetricType
+func (g *gcpSink) listMetricDescriptors() ([]*metric.MetricDescriptor, error) {
+	req := &monitoringpb.ListMetricDescriptorsRequest{
+		Name:   "projects/" + g.projectID,
+		Filter: fmt.Sprintf("metric.type = starts_with(%q)", metricTypePrefix()),
+	}
+
+	var descriptors []*metric.MetricDescriptor
+
+	it := g.client.ListMetricDescriptors(context.Background(), req)
+	for {
+		d, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		descriptors = append(descriptors, d)
+	}
+
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].Type < descriptors[j].Type
+	})
+
+	return descriptors, nil
+}
+
+func (g *gcpSink) createMetricDescriptor(d *metric.MetricDescriptor) error {
+	req := &monitoringpb.CreateMetricDescriptorRequest{
+		Name:             "projects/" + g.projectID,
+		MetricDescriptor: d,
+	}
+
+	if _, err := g.client.CreateMetricDescriptor(context.Background(), req); err != nil {
+		return fmt.Errorf("%s: %s", d.Type, err.Error())
+	}
+
+	return nil
+}
+
+func (g *gcpSink) deleteMetricDescriptor(d *metric.MetricDescriptor) error {
+	req := &monitoringpb.DeleteMetricDescriptorRequest{
+		Name: "projects/" + g.projectID + "/metricDescriptors/" + d.Type,
+	}
+
+	if err := g.client.DeleteMetricDescriptor(context.Background(), req); err != nil {
+		return fmt.Errorf("%s: %s", d.Type, err.Error())
+	}
+
+	return nil
+}
+
+// reconcileMetricsDescriptors creates missing descriptors, adds missing
+// labels and reports incompatible ones, they're left untouched since
+// recreating them drops their data, see the descriptors command
+func (g *gcpSink) reconcileMetricsDescriptors(desired []*metric.MetricDescriptor) error {
+	existing, err := g.listMetricDescriptors()
+	if err != nil {
+		return err
+	}
+
+	diff := diffDescriptors(desired, allDescriptors(), existing)
+
+	for _, d := range diff.missing {
+		if err := g.createMetricDescriptor(d); err != nil {
+			_ = g.slog.Err(err.Error())
+			continue
+		}
+
+		_ = g.slog.Info("Metric descriptor created for " + d.Type)
+	}
+
+	for _, c := range diff.labels {
+		if err := g.addMetricDescriptorLabels(c); err != nil {
+			_ = g.slog.Err(err.Error())
+			continue
+		}
+
+		_ = g.slog.Info(fmt.Sprintf("Metric descriptor %s updated: %s", c.desired.Type, strings.Join(c.reasons, ", ")))
+	}
+
+	for _, c := range diff.incompatible {
+		_ = g.slog.Err(fmt.Sprintf("Metric descriptor %s is incompatible: %s", c.desired.Type, strings.Join(c.reasons, ", ")))
+	}
+
+	_ = g.slog.Info(fmt.Sprintf("%d metric descriptors up to date", len(desired)-len(diff.missing)-len(diff.labels)-len(diff.incompatible)))
+
+	return nil
+}
+
+// runDescriptorsCommand runs "descriptors list|diff|apply|delete-stale"
+// against the catalog of --metrics-config-path, it returns the exit code
+func runDescriptorsCommand(args []string, w io.Writer) int {
+	if len(args) != 2 || args[0] != "descriptors" {
+		fmt.Fprintln(w, "Usage: gcp-gpu-metrics [flags] descriptors list|diff|apply|delete-stale")
+		return 2
+	}
+
+	// queries aren't validated against nvidia-smi, which may be missing
+	if flagMetricsConfigPath != "" {
+		queries, err := loadQueries(flagMetricsConfigPath)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+
+		nvidiasmiQueries = queries
+	}
+
+	if err := validateMetricTypes(desiredDescriptors()); err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	project := flagProjectID
+	if project == "" {
+		mzone, err := retrieveInstanceMetadata("zone")
+		if err != nil {
+			fmt.Fprintln(w, "--project-id is required outside of GCE: "+err.Error())
+			return 1
+		}
+
+		project = strings.Split(mzone, "/")[1]
+	}
+
+	client, err := newMetricClient()
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	defer client.Close()
+
+	g := &gcpSink{client: client, projectID: project}
+
+	existing, err := g.listMetricDescriptors()
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	diff := diffDescriptors(desiredDescriptors(), allDescriptors(), existing)
+
+	switch args[1] {
+	case "list":
+		for _, d := range existing {
+			if !ownMetricType(d.Type) {
+				continue
+			}
+
+			keys := make([]string, 0, len(d.Labels))
+			for _, l := range d.Labels {
+				keys = append(keys, l.Key)
+			}
+
+			fmt.Fprintf(w, "%s %s %s [%s]\n", d.Type, d.MetricKind, d.ValueType, strings.Join(keys, ","))
+		}
+	case "diff":
+		printDiff(w, diff)
+		if !diff.empty() {
+			return 3
+		}
+	case "apply":
+		// missing labels are added, incompatible descriptors are deleted
+		// with their data and recreated
+		failed := false
+		for _, c := range diff.labels {
+			if err := g.addMetricDescriptorLabels(c); err != nil {
+				fmt.Fprintln(w, err)
+				failed = true
+				continue
+			}
+
+			fmt.Fprintln(w, "updated "+c.desired.Type)
+		}
+
+		for _, c := range diff.incompatible {
+			if err := g.deleteMetricDescriptor(c.existing); err != nil {
+				fmt.Fprintln(w, err)
+				failed = true
+				continue
+			}
+
+			diff.missing = append(diff.missing, c.desired)
+		}
+
+		for _, d := range diff.missing {
+			if err := g.createMetricDescriptor(d); err != nil {
+				fmt.Fprintln(w, err)
+				failed = true
+				continue
+			}
+
+			fmt.Fprintln(w, "created "+d.Type)
+		}
+
+		if failed {
+			return 1
+		}
+	case "delete-stale":
+		failed := false
+		for _, d := range diff.stale {
+			if err := g.deleteMetricDescriptor(d); err != nil {
+				fmt.Fprintln(w, err)
+				failed = true
+				continue
+			}
+
+			fmt.Fprintln(w, "deleted "+d.Type)
+		}
+
+		if failed {
+			return 1
+		}
+	default:
+		fmt.Fprintf(w, "Unknown descriptors command %q\n", args[1])
+		return 2
+	}
+
+	return 0
+}
+
+func printDiff(w io.Writer, diff descriptorDiff) {
+	for _, d := range diff.missing {
+		fmt.Fprintf(w, "+ %s %s %s\n", d.Type, d.MetricKind, d.ValueType)
+	}
+
+	for _, c := range diff.labels {
+		fmt.Fprintf(w, "* %s: %s\n", c.desired.Type, strings.Join(c.reasons, ", "))
+	}
+
+	for _, c := range diff.incompatible {
+		fmt.Fprintf(w, "~ %s: %s\n", c.desired.Type, strings.Join(c.reasons, ", "))
+	}
+
+	for _, d := range diff.stale {
+		fmt.Fprintf(w, "- %s\n", d.Type)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDiffDescriptors(t *testing.T) {
+	// run from a workstation without the optional flags of the fleet
+	defer func(xid string, mig bool, interval uint64) {
+		flagXIDSource, flagEnableMIG, flagSampleIntervalMs = xid, mig, interval
+	}(flagXIDSource, flagEnableMIG, flagSampleIntervalMs)
+
+	flagXIDSource, flagEnableMIG, flagSampleIntervalMs = xidSourceNone, false, 0
+
+	// existing descriptors of a fleet sampling in distribution mode with
+	// XID errors and MIG enabled
+	existing := catalogDescriptors([]string{exportModeDistribution}, true, true)
+
+	byType := map[string]*metric.MetricDescriptor{}
+	for i, d := range existing {
+		existing[i] = proto.Clone(d).(*metric.MetricDescriptor)
+		byType[d.Type] = existing[i]
+	}
+
+	temperature := byType["custom.googleapis.com/gpu/temperature_gpu"]
+	temperature.Labels = temperature.Labels[:len(temperature.Labels)-1]
+
+	power := byType["custom.googleapis.com/gpu/power_draw"]
+	power.MetricKind = metric.MetricDescriptor_CUMULATIVE
+
+	removed := &metric.MetricDescriptor{Type: "custom.googleapis.com/gpu/removed_query"}
+	nested := &metric.MetricDescriptor{Type: "custom.googleapis.com/gpu/teamb/temperature_gpu"}
+	existing = append(existing, removed, nested)
+
+	diff := diffDescriptors(desiredDescriptors(), allDescriptors(), existing)
+
+	if len(diff.missing) != 0 {
+		t.Errorf("got %d missing descriptors, want 0", len(diff.missing))
+	}
+
+	if len(diff.labels) != 1 || diff.labels[0].existing != temperature {
+		t.Errorf("got descriptors lacking labels %v, want %s", diff.labels, temperature.Type)
+	} else if got := diff.labels[0].reasons; len(got) != 1 || got[0] != "missing labels instance_name" {
+		t.Errorf("got reasons %v", got)
+	}
+
+	if len(diff.incompatible) != 1 || diff.incompatible[0].existing != power {
+		t.Errorf("got incompatible descriptors %v, want %s", diff.incompatible, power.Type)
+	}
+
+	// MIG, XID and sampled descriptors of the fleet and descriptors of a
+	// longer prefix aren't stale
+	if len(diff.stale) != 1 || diff.stale[0] != removed {
+		types := make([]string, 0, len(diff.stale))
+		for _, d := range diff.stale {
+			types = append(types, d.Type)
+		}
+		t.Errorf("got stale descriptors %v, want %s", types, removed.Type)
+	}
+}
+
+func TestOwnMetricType(t *testing.T) {
+	tests := []struct {
+		metricType string
+		want       bool
+	}{
+		{metricType: "custom.googleapis.com/gpu/temperature_gpu", want: true},
+		{metricType: "custom.googleapis.com/gpu/collector_timeouts", want: true},
+		{metricType: "custom.googleapis.com/gpu/teamb/temperature_gpu", want: false},
+		{metricType: "custom.googleapis.com/gpus/temperature_gpu", want: false},
+		{metricType: "workload.googleapis.com/gpu/temperature_gpu", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := ownMetricType(tt.metricType); got != tt.want {
+			t.Errorf("ownMetricType(%q) = %v, want %v", tt.metricType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errCommandTimeout = errors.New("command timed out")
+
+	// nvidiasmiTimeouts counts nvidia-smi calls killed on timeout
+	nvidiasmiTimeouts int64
+	// nvidiasmiKilled counts nvidia-smi calls killed on timeout which
+	// didn't exit yet
+	nvidiasmiKilled int64
+)
+
+// nvidiasmiOutput runs nvidia-smi with args under timeout and returns its stdout,
+// nvidia-smi is executed directly without shell
+func nvidiasmiOutput(args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(flagNvidiasmiPath, args...)
+	cmd.Stdout = &stdout
+
+	// a killed command may still write its output
+	if err := runWithTimeout(cmd); err == errCommandTimeout {
+		return nil, err
+	} else if err != nil {
+		return stdout.Bytes(), err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// nvidiasmiCombinedOutput runs nvidia-smi with args under timeout and returns
+// its stdout and stderr
+func nvidiasmiCombinedOutput(args ...string) ([]byte, error) {
+	var output bytes.Buffer
+
+	cmd := exec.Command(flagNvidiasmiPath, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// a killed command may still write its output
+	if err := runWithTimeout(cmd); err == errCommandTimeout {
+		return nil, err
+	} else if err != nil {
+		return output.Bytes(), err
+	}
+
+	return output.Bytes(), nil
+}
+
+// runWithTimeout runs cmd in its own process group, the whole group is
+// killed once the nvidia-smi timeout expires. A wedged driver can make
+// nvidia-smi unkillable, so the command is reaped in background after
+// the kill and counted by nvidiasmiKilled until it exits
+func runWithTimeout(cmd *exec.Cmd) error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(flagNvidiasmiTimeout)*time.Second)
+	defer cancel()
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		atomic.AddInt64(&nvidiasmiTimeouts, 1)
+
+		atomic.AddInt64(&nvidiasmiKilled, 1)
+		go func() {
+			<-done
+			atomic.AddInt64(&nvidiasmiKilled, -1)
+		}()
+
+		return errCommandTimeout
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// fakeQueryGPUFixture is an nvidia-smi --query-gpu CSV output with header
+	fakeQueryGPUFixture = "query-gpu.csv"
+	// fakeQueryComputeAppsFixture is an nvidia-smi --query-compute-apps CSV output
+	// with header, it's optional
+	fakeQueryComputeAppsFixture = "query-compute-apps.csv"
+	// fakeQueryXMLFixture is an nvidia-smi -q -x output, it's optional
+	fakeQueryXMLFixture = "query-xml.xml"
+	// fakeMIGListGIFixture is an nvidia-smi mig -lgi output, it's optional
+	fakeMIGListGIFixture = "mig-lgi.txt"
+)
+
+// fakeCollector is a Collector reading captured nvidia-smi outputs
+// from a fixtures directory, it permits to run the exporter without GPU
+type fakeCollector struct {
+	fixturesPath string
+}
+
+func (c *fakeCollector) GPUAmount() (int, error) {
+	samples, err := c.Collect(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(samples), nil
+}
+
+// Collect reads the fixture on each call so it can be edited while running
+func (c *fakeCollector) Collect(queries []nvidiasmiQuery) ([]gpuSample, error) {
+	o, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeQueryGPUFixture))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGPUSamples(o, queries, nil)
+}
+
+// Identities reads uuid, serial and name columns of the query-gpu fixture
+func (c *fakeCollector) Identities() ([]gpuIdentity, error) {
+	o, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeQueryGPUFixture))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIdentities(o, nil)
+}
+
+// CollectProcesses returns no process if the fixture doesn't exist
+func (c *fakeCollector) CollectProcesses() ([]processSample, error) {
+	o, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeQueryComputeAppsFixture))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseProcessSamples(o)
+}
+
+// CollectMIG returns no MIG GPU if the query-xml fixture doesn't exist
+func (c *fakeCollector) CollectMIG(samples []gpuSample) ([]migGPU, error) {
+	qx, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeQueryXMLFixture))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lgi, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeMIGListGIFixture))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return parseMIG(qx, lgi, samples)
+}
+
+// SupportedQueries returns the columns of the query-gpu fixture
+func (c *fakeCollector) SupportedQueries() ([]string, error) {
+	o, err := ioutil.ReadFile(filepath.Join(c.fixturesPath, fakeQueryGPUFixture))
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := csv.NewReader(bytes.NewReader(o)).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := headerColumns(header)
+
+	fields := make([]string, 0, len(columns))
+	for name := range columns {
+		fields = append(fields, name)
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/syslog"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"google.golang.org/api/option"
+	distribution "google.golang.org/genproto/googleapis/api/distribution"
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gcpSink writes metrics to Cloud Monitoring
+type gcpSink struct {
+	client    *monitoring.MetricClient
+	projectID string
+	resource  *monitoredres.MonitoredResource
+	slog      *syslog.Writer
+	writers   chan struct{}
+	queue     *diskQueue
+}
+
+// newGCPSink returns a Cloud Monitoring sink of projectID writing points
+// of resource, unsent points are queued on disk and drained in background
+// if a queue path is set
+func newGCPSink(slog *syslog.Writer, projectID string, resource *monitoredres.MonitoredResource) (*gcpSink, error) {
+	client, err := newMetricClient()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &gcpSink{
+		client:    client,
+		projectID: projectID,
+		resource:  resource,
+		slog:      slog,
+		writers:   make(chan struct{}, maxWriteWorkers),
+	}
+
+	if flagQueuePath != "" {
+		g.queue, err = newDiskQueue(flagQueuePath, int64(flagQueueMaxSizeMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = slog.Info("Queue unsent points in " + flagQueuePath)
+		go g.drainQueue(time.Duration(flagFetchMetricsInterval) * time.Second)
+	}
+
+	return g, nil
+}
+
+// Describe creates missing metric descriptors
+func (g *gcpSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	return g.reconcileMetricsDescriptors(descriptors)
+}
+
+func (g *gcpSink) Write(b *timeSeriesBatch) error {
+	return g.writeBatch(b)
+}
+
+// Flush does nothing, Write returns once requests are done
+func (g *gcpSink) Flush() error {
+	return nil
+}
+
+func (g *gcpSink) Close() error {
+	return g.client.Close()
+}
+
+// gceInstance returns the monitored resource of a GCE instance
+func gceInstance(projectID string, instanceID string, zone string) *monitoredres.MonitoredResource {
+	return &monitoredres.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"instance_id": instanceID,
+			"zone":        zone,
+			"project_id":  projectID,
+		},
+	}
+}
+
+// timeSeries converts a point to a Cloud Monitoring time series of the sink resource
+func (g *gcpSink) timeSeries(ts *timeSeries) *monitoringpb.TimeSeries {
+	interval := &monitoringpb.TimeInterval{
+		EndTime: timestamppb.New(ts.end),
+	}
+
+	if !ts.start.IsZero() {
+		interval.StartTime = timestamppb.New(ts.start)
+	}
+
+	return &monitoringpb.TimeSeries{
+		Metric: &metric.Metric{
+			Type:   ts.metricType,
+			Labels: ts.labels,
+		},
+		Resource:   g.resource,
+		MetricKind: ts.kind,
+		ValueType:  ts.valueType,
+		Points: []*monitoringpb.Point{
+			{
+				Interval: interval,
+				Value:    typedValue(ts),
+			},
+		},
+	}
+}
+
+// typedValue returns the Cloud Monitoring value of a point
+func typedValue(ts *timeSeries) *monitoringpb.TypedValue {
+	switch ts.valueType {
+	case metric.MetricDescriptor_DOUBLE:
+		return &monitoringpb.TypedValue{
+			Value: &monitoringpb.TypedValue_DoubleValue{
+				DoubleValue: ts.value,
+			},
+		}
+	case metric.MetricDescriptor_BOOL:
+		return &monitoringpb.TypedValue{
+			Value: &monitoringpb.TypedValue_BoolValue{
+				BoolValue: ts.value != 0,
+			},
+		}
+	case metric.MetricDescriptor_DISTRIBUTION:
+		return &monitoringpb.TypedValue{
+			Value: &monitoringpb.TypedValue_DistributionValue{
+				DistributionValue: distributionProto(ts.distribution),
+			},
+		}
+	}
+
+	return &monitoringpb.TypedValue{
+		Value: &monitoringpb.TypedValue_Int64Value{
+			Int64Value: int64(ts.value),
+		},
+	}
+}
+
+// distributionProto returns the Cloud Monitoring distribution of a histogram
+func distributionProto(h *histogram) *distribution.Distribution {
+	d := &distribution.Distribution{
+		Count:                 h.count,
+		Mean:                  h.mean,
+		SumOfSquaredDeviation: h.sumOfSquaredDeviation,
+		BucketCounts:          h.bucketCounts,
+	}
+
+	if len(h.bounds) > 0 {
+		d.BucketOptions = &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExplicitBuckets{
+				ExplicitBuckets: &distribution.Distribution_BucketOptions_Explicit{
+					Bounds: h.bounds,
+				},
+			},
+		}
+	} else {
+		d.BucketOptions = &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExponentialBuckets{
+				ExponentialBuckets: &distribution.Distribution_BucketOptions_Exponential{
+					NumFiniteBuckets: defaultBucketsCount,
+					GrowthFactor:     defaultBucketsGrowth,
+					Scale:            defaultBucketsScale,
+				},
+			},
+		}
+	}
+
+	return d
+}
+
+func newMetricClient() (*monitoring.MetricClient, error) {
+	ctx := context.Background()
+
+	if flagServiceAccountPath == "" {
+		return monitoring.NewMetricClient(ctx)
+	}
+
+	return monitoring.NewMetricClient(ctx, option.WithCredentialsFile(flagServiceAccountPath))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	inventoryAdded   = "added"
+	inventoryRemoved = "removed"
+)
+
+// inventoryChange is a GPU appearing or vanishing between two snapshots
+type inventoryChange struct {
+	sample gpuSample
+	change string
+}
+
+// inventoryKey identifies an inventory changes counter
+type inventoryKey struct {
+	busID  string
+	change string
+}
+
+// inventory keeps track of GPUs seen in the last snapshot,
+// GPUs are identified by PCI bus id since indexes can be reused
+type inventory struct {
+	mu          sync.Mutex
+	initialized bool
+	gpus        map[string]gpuSample
+	counts      map[inventoryKey]int64
+	identities  map[string]gpuIdentity
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		gpus:       make(map[string]gpuSample),
+		counts:     make(map[inventoryKey]int64),
+		identities: make(map[string]gpuIdentity),
+	}
+}
+
+// update replaces known GPUs with the snapshot ones and returns changes,
+// the first snapshot is the initial inventory and returns no change
+func (i *inventory) update(samples []gpuSample) []inventoryChange {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	gpus := make(map[string]gpuSample, len(samples))
+	for _, sample := range samples {
+		gpus[sample.BusID] = sample
+	}
+
+	var changes []inventoryChange
+
+	if i.initialized {
+		for busID, sample := range gpus {
+			if _, ok := i.gpus[busID]; !ok {
+				changes = append(changes, inventoryChange{sample: sample, change: inventoryAdded})
+			}
+		}
+
+		for busID, sample := range i.gpus {
+			if _, ok := gpus[busID]; !ok {
+				changes = append(changes, inventoryChange{sample: sample, change: inventoryRemoved})
+			}
+		}
+	}
+
+	for _, c := range changes {
+		i.counts[inventoryKey{busID: c.sample.BusID, change: c.change}]++
+	}
+
+	i.gpus = gpus
+	i.initialized = true
+
+	return changes
+}
+
+// snapshot returns a copy of every inventory changes counter
+func (i *inventory) snapshot() map[inventoryKey]int64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	counts := make(map[inventoryKey]int64, len(i.counts))
+	for k, v := range i.counts {
+		counts[k] = v
+	}
+
+	return counts
+}
+
+// missingIdentity returns true if a GPU of the snapshot has no cached identity
+func (i *inventory) missingIdentity(samples []gpuSample) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, sample := range samples {
+		if _, ok := i.identities[sample.BusID]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setIdentities replaces cached identities
+func (i *inventory) setIdentities(identities []gpuIdentity) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.identities = make(map[string]gpuIdentity, len(identities))
+	for _, id := range identities {
+		i.identities[id.BusID] = id
+	}
+}
+
+// identity returns the cached identity of a GPU
+func (i *inventory) identity(busID string) (gpuIdentity, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	id, ok := i.identities[busID]
+	return id, ok
+}
@@ -1,20 +1,43 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/syslog"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 )
 
 var (
 	// flags related
 
-	flagDisplayVersion       bool   = false
-	flagServiceAccountPath   string = ""
-	flagFetchMetricsInterval uint64 = 10
-	flagEnableNvidiasmipm    bool   = false
+	flagDisplayVersion        bool   = false
+	flagServiceAccountPath    string = ""
+	flagFetchMetricsInterval  uint64 = 10
+	flagEnableNvidiasmipm     bool   = false
+	flagFakeFixturesPath      string = ""
+	flagMetricsConfigPath     string = ""
+	flagXIDSource             string = xidSourceKmsg
+	flagEnableNvidiasmiStream bool   = false
+	flagEnableMIG             bool   = false
+	flagSampleIntervalMs      uint64 = 0
+	flagExportMode            string = exportModeSummary
+	flagNvidiasmiTimeout      uint64 = 5
+	flagNvidiasmiPath         string = "nvidia-smi"
+	flagQueuePath             string = ""
+	flagQueueMaxSizeMB        uint64 = 100
+	flagProjectID             string = ""
+	flagMetricDomain          string = metricDomainCustom
+	flagMetricPrefix          string = "gpu"
+	flagEnableGCP             bool   = true
+	flagPrometheusAddress     string = ""
+	flagOTLPEndpoint          string = ""
+	flagOTLPProtocol          string = otlpProtocolGRPC
+	flagOTLPInsecure          bool   = false
+	flagDryRun                bool   = false
 
 	envVarPrefix = "GGM_"
 
@@ -49,6 +72,130 @@ func evaluateEnvVars() {
 			flagEnableNvidiasmipm = v
 		}
 	}
+
+	tmpFFP := os.Getenv(envVarPrefix + "FAKE_FIXTURES_PATH")
+	if tmpFFP != "" {
+		flagFakeFixturesPath = tmpFFP
+	}
+
+	tmpMCP := os.Getenv(envVarPrefix + "METRICS_CONFIG_PATH")
+	if tmpMCP != "" {
+		flagMetricsConfigPath = tmpMCP
+	}
+
+	tmpXS := os.Getenv(envVarPrefix + "XID_SOURCE")
+	if tmpXS != "" {
+		flagXIDSource = tmpXS
+	}
+
+	tmpENS := os.Getenv(envVarPrefix + "ENABLE_NVIDIASMI_STREAM")
+	if tmpENS != "" {
+		v, err := strconv.ParseBool(tmpENS)
+		if err == nil {
+			flagEnableNvidiasmiStream = v
+		}
+	}
+
+	tmpEM := os.Getenv(envVarPrefix + "ENABLE_MIG")
+	if tmpEM != "" {
+		v, err := strconv.ParseBool(tmpEM)
+		if err == nil {
+			flagEnableMIG = v
+		}
+	}
+
+	tmpSI := os.Getenv(envVarPrefix + "SAMPLE_INTERVAL_MS")
+	if tmpSI != "" {
+		v, err := strconv.ParseUint(tmpSI, 10, 64)
+		if err == nil {
+			flagSampleIntervalMs = v
+		}
+	}
+
+	tmpEXM := os.Getenv(envVarPrefix + "EXPORT_MODE")
+	if tmpEXM != "" {
+		flagExportMode = tmpEXM
+	}
+
+	tmpNT := os.Getenv(envVarPrefix + "NVIDIASMI_TIMEOUT")
+	if tmpNT != "" {
+		v, err := strconv.ParseUint(tmpNT, 10, 64)
+		if err == nil {
+			flagNvidiasmiTimeout = v
+		}
+	}
+
+	tmpNP := os.Getenv(envVarPrefix + "NVIDIASMI_PATH")
+	if tmpNP != "" {
+		flagNvidiasmiPath = tmpNP
+	}
+
+	tmpPID := os.Getenv(envVarPrefix + "PROJECT_ID")
+	if tmpPID != "" {
+		flagProjectID = tmpPID
+	}
+
+	tmpMD := os.Getenv(envVarPrefix + "METRIC_DOMAIN")
+	if tmpMD != "" {
+		flagMetricDomain = tmpMD
+	}
+
+	tmpMP := os.Getenv(envVarPrefix + "METRIC_PREFIX")
+	if tmpMP != "" {
+		flagMetricPrefix = tmpMP
+	}
+
+	tmpEG := os.Getenv(envVarPrefix + "ENABLE_GCP")
+	if tmpEG != "" {
+		v, err := strconv.ParseBool(tmpEG)
+		if err == nil {
+			flagEnableGCP = v
+		}
+	}
+
+	tmpPA := os.Getenv(envVarPrefix + "PROMETHEUS_ADDRESS")
+	if tmpPA != "" {
+		flagPrometheusAddress = tmpPA
+	}
+
+	tmpOE := os.Getenv(envVarPrefix + "OTLP_ENDPOINT")
+	if tmpOE != "" {
+		flagOTLPEndpoint = tmpOE
+	}
+
+	tmpOP := os.Getenv(envVarPrefix + "OTLP_PROTOCOL")
+	if tmpOP != "" {
+		flagOTLPProtocol = tmpOP
+	}
+
+	tmpOI := os.Getenv(envVarPrefix + "OTLP_INSECURE")
+	if tmpOI != "" {
+		v, err := strconv.ParseBool(tmpOI)
+		if err == nil {
+			flagOTLPInsecure = v
+		}
+	}
+
+	tmpDR := os.Getenv(envVarPrefix + "DRY_RUN")
+	if tmpDR != "" {
+		v, err := strconv.ParseBool(tmpDR)
+		if err == nil {
+			flagDryRun = v
+		}
+	}
+
+	tmpQP := os.Getenv(envVarPrefix + "QUEUE_PATH")
+	if tmpQP != "" {
+		flagQueuePath = tmpQP
+	}
+
+	tmpQMS := os.Getenv(envVarPrefix + "QUEUE_MAX_SIZE_MB")
+	if tmpQMS != "" {
+		v, err := strconv.ParseUint(tmpQMS, 10, 64)
+		if err == nil {
+			flagQueueMaxSizeMB = v
+		}
+	}
 }
 
 func main() {
@@ -58,6 +205,26 @@ func main() {
 	flag.StringVar(&flagServiceAccountPath, "service-account-path", flagServiceAccountPath, "GCP service account path.")
 	flag.Uint64Var(&flagFetchMetricsInterval, "metrics-interval", flagFetchMetricsInterval, "Fetch metrics interval in seconds.")
 	flag.BoolVar(&flagEnableNvidiasmipm, "enable-nvidiasmi-pm", flagEnableNvidiasmipm, "Enable persistant mod for nvidia-smi.")
+	flag.StringVar(&flagFakeFixturesPath, "fake-fixtures-path", flagFakeFixturesPath, "Read GPU metrics from nvidia-smi fixtures directory instead of nvidia-smi.")
+	flag.StringVar(&flagMetricsConfigPath, "metrics-config-path", flagMetricsConfigPath, "JSON metrics config path, replace default queries.")
+	flag.Uint64Var(&flagSampleIntervalMs, "sample-interval-ms", flagSampleIntervalMs, "Sample metrics interval in milliseconds, 0 to sample once per fetch metrics interval.")
+	flag.StringVar(&flagExportMode, "export-mode", flagExportMode, "Export mode of sampled metrics, \"summary\" or \"distribution\".")
+	flag.StringVar(&flagNvidiasmiPath, "nvidiasmi-path", flagNvidiasmiPath, "nvidia-smi binary path, looked up in PATH if not absolute.")
+	flag.StringVar(&flagProjectID, "project-id", flagProjectID, "GCP project ID, read from the metadata server if empty.")
+	flag.BoolVar(&flagEnableGCP, "enable-gcp", flagEnableGCP, "Export metrics to GCP monitoring.")
+	flag.StringVar(&flagPrometheusAddress, "prometheus-address", flagPrometheusAddress, "Listen address of the Prometheus /metrics endpoint, e.g. \":9400\", disabled if empty.")
+	flag.StringVar(&flagOTLPEndpoint, "otlp-endpoint", flagOTLPEndpoint, "OTLP collector endpoint, host:port for gRPC or base URL for HTTP, disabled if empty.")
+	flag.StringVar(&flagOTLPProtocol, "otlp-protocol", flagOTLPProtocol, "OTLP protocol, \"grpc\" or \"http/json\".")
+	flag.BoolVar(&flagOTLPInsecure, "otlp-insecure", flagOTLPInsecure, "Disable TLS of OTLP gRPC connection.")
+	flag.BoolVar(&flagDryRun, "dry-run", flagDryRun, "Print metrics to stdout as JSON lines instead of exporting them.")
+	flag.StringVar(&flagMetricDomain, "metric-domain", flagMetricDomain, "Metric types domain, \"custom.googleapis.com\" or \"workload.googleapis.com\".")
+	flag.StringVar(&flagMetricPrefix, "metric-prefix", flagMetricPrefix, "Metric types path prefix after the domain, e.g. \"team/gpu\".")
+	flag.StringVar(&flagQueuePath, "queue-path", flagQueuePath, "Directory of the on-disk queue of unsent points, disabled if empty.")
+	flag.Uint64Var(&flagQueueMaxSizeMB, "queue-max-size-mb", flagQueueMaxSizeMB, "Max size of the on-disk queue in megabytes, oldest points are dropped beyond.")
+	flag.Uint64Var(&flagNvidiasmiTimeout, "nvidiasmi-timeout", flagNvidiasmiTimeout, "Timeout of nvidia-smi calls in seconds, at least 1.")
+	flag.BoolVar(&flagEnableNvidiasmiStream, "enable-nvidiasmi-stream", flagEnableNvidiasmiStream, "Read metrics from a long-running nvidia-smi process instead of one call per interval.")
+	flag.BoolVar(&flagEnableMIG, "enable-mig", flagEnableMIG, "Enable Multi-Instance GPU metrics.")
+	flag.StringVar(&flagXIDSource, "xid-source", flagXIDSource, "XID errors source, kernel log file path, \"journal\" or \"none\" to disable.")
 	flag.Parse()
 
 	if flagDisplayVersion {
@@ -66,6 +233,27 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flagExportMode != exportModeSummary && flagExportMode != exportModeDistribution {
+		fmt.Printf("Unsupported export mode %q\n", flagExportMode)
+		os.Exit(1)
+	}
+
+	// a zero timeout would kill every nvidia-smi call right away
+	if flagNvidiasmiTimeout == 0 {
+		fmt.Println("Invalid nvidia-smi timeout 0, at least 1 second expected")
+		os.Exit(1)
+	}
+
+	// descriptors management command, usable from a workstation with --project-id
+	if flag.NArg() > 0 {
+		os.Exit(runDescriptorsCommand(flag.Args(), os.Stdout))
+	}
+
+	if !flagDryRun && !flagEnableGCP && flagPrometheusAddress == "" && flagOTLPEndpoint == "" {
+		fmt.Println("No exporter enabled, set --prometheus-address, --otlp-endpoint or --enable-gcp")
+		os.Exit(1)
+	}
+
 	// init syslogger
 	slog, err := newSyslogger()
 	if err != nil {
@@ -73,47 +261,105 @@ func main() {
 		os.Exit(1)
 	}
 
-	// check if nvidia-smi binary is present on the instance
-	if err := isNvidiasmiExist(); err != nil {
-		_ = slog.Err(err.Error())
-		os.Exit(1)
+	collector := newCollector(slog)
+
+	if flagFakeFixturesPath == "" {
+		// check if nvidia-smi binary is present on the instance
+		if err := isNvidiasmiExist(); err != nil {
+			_ = slog.Err(err.Error())
+			os.Exit(1)
+		}
+		_ = slog.Info("nvidia-smi detected")
+
+		// enable nvidia-smi persistence mod, the agent doesn't run
+		// without the privileges it was asked to use
+		if flagEnableNvidiasmipm {
+			if err := enablePMNvidiasmi(); errors.Is(err, errInsufficientPermissions) {
+				_ = slog.Err(err.Error())
+				os.Exit(1)
+			} else if err != nil {
+				_ = slog.Err(err.Error())
+			} else {
+				_ = slog.Info("nvidia-smi persistence mod enabled")
+			}
+		}
+	} else {
+		_ = slog.Info("fake collector enabled with fixtures from " + flagFakeFixturesPath)
 	}
-	_ = slog.Info("nvidia-smi detected")
 
-	// enable nvidia-smi persistence mod
-	if flagEnableNvidiasmipm {
-		if err := enablePMNvidiasmi(); err != nil {
-			_ = slog.Info(err.Error())
-		} else {
-			_ = slog.Info("nvidia-smi persistence mod enabled")
+	// load and validate user-defined queries
+	if flagMetricsConfigPath != "" {
+		queries, err := loadQueries(flagMetricsConfigPath)
+		if err != nil {
+			_ = slog.Err(err.Error())
+			os.Exit(1)
 		}
+
+		supported, err := collector.SupportedQueries()
+		if err != nil {
+			_ = slog.Err(err.Error())
+			os.Exit(1)
+		}
+
+		if err := validateQueries(queries, supported); err != nil {
+			_ = slog.Err(err.Error())
+			os.Exit(1)
+		}
+
+		nvidiasmiQueries = queries
+		_ = slog.Info(fmt.Sprintf("%d queries loaded from %s", len(queries), flagMetricsConfigPath))
 	}
 
-	// get GPU amount on the instance
-	gpuAmount, err := getGPUAmount()
-	if err != nil {
+	if err := validateMetricTypes(desiredDescriptors()); err != nil {
 		_ = slog.Err(err.Error())
 		os.Exit(1)
 	}
-	_ = slog.Info(fmt.Sprintf("%d GPU(s) detected\n", gpuAmount))
 
-	// create a new GCP auth service
-	s, err := newService(slog)
+	// get GPU amount on the instance
+	// GPUs are enumerated again at each interval, so it's not fatal
+	gpuAmount, err := collector.GPUAmount()
+	if err != nil {
+		_ = slog.Warning(err.Error())
+	} else {
+		_ = slog.Info(fmt.Sprintf("%d GPU(s) detected\n", gpuAmount))
+	}
+
+	// watch XID errors in background
+	var xid *xidWatcher
+	if flagXIDSource != xidSourceNone {
+		xid = newXIDWatcher(flagXIDSource, slog)
+		go xid.watch()
+		_ = slog.Info("XID errors watched from " + flagXIDSource)
+	}
+
+	// create a new service, with a GCP client if enabled
+	s, err := newService(slog, collector, xid)
 	if err != nil {
 		_ = slog.Err(err.Error())
 		os.Exit(1)
 	}
 
-	defer s.Close()
-
-	// creation loop of metrics descriptors
-	if err := s.createMetricsDescriptors(); err != nil {
+	// declare metrics to sinks, GCP missing descriptors are created
+	// and incompatible ones are reported
+	if err := s.sink.Describe(desiredDescriptors()); err != nil {
 		_ = slog.Err(err.Error())
 		os.Exit(1)
 	}
 
-	// fetch metrics infinite loop
-	s.fetchMetrics(gpuAmount)
+	// flush pending writes on termination
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	// fetch metrics loop
+	go s.fetchMetrics()
+
+	<-sig
+	_ = slog.Info("Flush metrics before exit")
+
+	// no batch is written once stopped, so the flush is complete
+	s.stop()
+	_ = s.sink.Flush()
+	_ = s.sink.Close()
 
 	os.Exit(0)
 }
@@ -1,21 +1,17 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
 	"log/syslog"
+	"math"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
-	"google.golang.org/api/option"
-	label "google.golang.org/genproto/googleapis/api/label"
 	metric "google.golang.org/genproto/googleapis/api/metric"
-	monitoredres "google.golang.org/genproto/googleapis/api/monitoredres"
-	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
@@ -23,59 +19,145 @@ const (
 )
 
 type service struct {
-	*monitoring.MetricClient
 	zone         string
 	projectID    string
 	instanceID   string
 	instanceName string
 	slog         *syslog.Writer
+	collector    Collector
+	cumulative   *cumulativeTracker
+	xid          *xidWatcher
+	inventory    *inventory
+	buffer       *sampleBuffer
+	inflight     chan struct{}
+	sink         Sink
+	done         chan struct{}
+	stopped      chan struct{}
 }
 
-func newService(slog *syslog.Writer) (*service, error) {
-	ctx := context.Background()
+func newService(slog *syslog.Writer, collector Collector, xid *xidWatcher) (*service, error) {
+	s := &service{
+		slog:       slog,
+		collector:  collector,
+		cumulative: newCumulativeTracker(),
+		xid:        xid,
+		inventory:  newInventory(),
+		buffer:     &sampleBuffer{},
+		inflight:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	// dry run needs neither credentials nor metadata server
+	if flagDryRun {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		s.instanceName = name
+		s.projectID = flagProjectID
+	} else if err := s.retrieveInstanceIdentity(); err != nil {
+		// GCP monitored resource requires the instance identity
+		if flagEnableGCP {
+			return nil, err
+		}
 
-	var client *monitoring.MetricClient
-	var err error
+		// without GCP sink, the instance name falls back to the
+		// hostname outside of GCE
+		name, herr := os.Hostname()
+		if herr != nil {
+			return nil, herr
+		}
 
-	if flagServiceAccountPath == "" {
-		client, err = monitoring.NewMetricClient(ctx)
-	} else {
-		client, err = monitoring.NewMetricClient(ctx, option.WithCredentialsFile(flagServiceAccountPath))
+		s.instanceName = name
 	}
+
+	sink, err := s.newSinks()
 	if err != nil {
 		return nil, err
 	}
 
-	s := &service{
-		MetricClient: client,
-		slog:         slog,
+	s.sink = sink
+
+	return s, nil
+}
+
+// newSinks returns a fan-out to every enabled sink, or to stdout only
+// in dry run, sinks are written by their own worker one batch at a time
+func (s *service) newSinks() (*fanoutSink, error) {
+	f := newFanoutSink(s.slog)
+
+	if flagDryRun {
+		_ = s.slog.Info("Dry run, print metrics to stdout instead of exporting them")
+		f.add("stdout", newStdoutSink(os.Stdout, gceInstance(s.projectID, s.instanceID, s.zone)))
+
+		return f, nil
 	}
 
+	if flagEnableGCP {
+		g, err := newGCPSink(s.slog, s.projectID, gceInstance(s.projectID, s.instanceID, s.zone))
+		if err != nil {
+			return nil, err
+		}
+
+		f.add("gcp", g)
+	}
+
+	if flagPrometheusAddress != "" {
+		p := newPrometheusSink()
+		if err := p.listen(flagPrometheusAddress); err != nil {
+			return nil, err
+		}
+
+		_ = s.slog.Info("Serve Prometheus metrics on " + flagPrometheusAddress)
+		f.add("prometheus", p)
+	}
+
+	if flagOTLPEndpoint != "" {
+		o, err := newOTLPSink(s, flagOTLPProtocol, flagOTLPEndpoint, flagOTLPInsecure)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = s.slog.Info("Export metrics over OTLP " + flagOTLPProtocol + " to " + flagOTLPEndpoint)
+		f.add("otlp", o)
+	}
+
+	return f, nil
+}
+
+// retrieveInstanceIdentity sets instance name, ID, zone and project ID
+func (s *service) retrieveInstanceIdentity() error {
 	// Get instance name by querying internal metadata server
 	name, err := retrieveInstanceMetadata("name")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Get projectID and zone by querying internal metadata server
 	mzone, err := retrieveInstanceMetadata("zone")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	s.zone = strings.Split(mzone, "/")[3]
 	s.projectID = strings.Split(mzone, "/")[1]
 	s.instanceName = name
 
+	if flagProjectID != "" {
+		s.projectID = flagProjectID
+	}
+
 	// Get instance ID by querying internal metadata server
 	mid, err := retrieveInstanceMetadata("id")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	s.instanceID = mid
 
-	return s, nil
+	return nil
 }
 
 func retrieveInstanceMetadata(mpath string) (string, error) {
@@ -99,144 +181,418 @@ func retrieveInstanceMetadata(mpath string) (string, error) {
 	return strings.Split(string(b), "\n")[0], nil
 }
 
-func (s *service) createMetricsDescriptors() error {
-	for _, query := range nvidiasmiQueries {
-		fquery := query.gcpFormat()
-
-		req := &monitoringpb.CreateMetricDescriptorRequest{
-			Name: "projects/" + s.projectID,
-			MetricDescriptor: &metric.MetricDescriptor{
-				Name:        fquery,
-				DisplayName: query.DisplayName,
-				Type:        "custom.googleapis.com/gpu/" + fquery,
-				MetricKind:  query.Kind,
-				ValueType:   query.Type,
-				Unit:        query.Unit,
-				Description: "gcp_gpu_metrics for " + fquery + " nvidia-smi query",
-				Labels: []*label.LabelDescriptor{
-					{
-						Key:         "gpu_id",
-						ValueType:   label.LabelDescriptor_STRING,
-						Description: "related gpu_id for " + fquery + " metric",
-					},
-					{
-						Key:         "bus_id",
-						ValueType:   label.LabelDescriptor_STRING,
-						Description: "related bus_id for " + fquery + " metric",
-					},
-					{
-						Key:         "instance_name",
-						ValueType:   label.LabelDescriptor_STRING,
-						Description: "related instance_name for " + fquery + " metric",
-					},
-				},
-			},
-		}
-
-		ctx := context.Background()
-
-		resp, err := s.CreateMetricDescriptor(ctx, req)
+var (
+	// labels of each metric family, instance_name is added to all of them
+
+	gpuLabels       = []string{"gpu_id", "bus_id", "gpu_uuid", "serial", "gpu_name"}
+	processLabels   = []string{"pid", "process_name", "gpu_uuid"}
+	xidLabels       = []string{"gpu_id", "bus_id", "gpu_uuid", "serial", "gpu_name", "xid"}
+	inventoryLabels = []string{"bus_id", "change"}
+	migLabels       = []string{"gpu_id", "bus_id", "gpu_uuid", "serial", "gpu_name", "mig_profile", "gpu_instance_id", "compute_instance_id"}
+)
+
+func (s *service) fetchMetrics() {
+	fmi := flagFetchMetricsInterval
+	_ = s.slog.Info(fmt.Sprintf("Start fetching metrics every %d seconds", fmi))
+
+	if flagSampleIntervalMs > 0 {
+		_ = s.slog.Info(fmt.Sprintf("Sample metrics every %d milliseconds", flagSampleIntervalMs))
+		go s.sampleMetrics()
+	}
+
+	// loop with fetch metrics interval * second sleep, until stopped
+	for {
+		if flagSampleIntervalMs > 0 {
+			go s.exportSamples()
+		} else {
+			go s.fetchSnapshot()
+		}
+
+		// published even when the tick is skipped by a hung collection
+		b := newTimeSeriesBatch()
+		s.addTimeSeries(b, float64(atomic.LoadInt64(&nvidiasmiTimeouts)), &collectorTimeoutsQuery, nil)
+		_ = s.sink.Write(b)
+
+		select {
+		case <-s.done:
+			close(s.stopped)
+			return
+		case <-time.After(time.Duration(fmi) * time.Second):
+		}
+	}
+}
+
+// stop ends the fetchMetrics loop and waits for the collection in flight,
+// nothing is written to the sink once it returns
+func (s *service) stop() {
+	close(s.done)
+	<-s.stopped
+
+	s.inflight <- struct{}{}
+}
+
+// sampleMetrics buffers a snapshot every sample interval,
+// they're exported every metrics interval by exportSamples
+func (s *service) sampleMetrics() {
+	for {
+		if s.killedRunning() {
+			time.Sleep(time.Duration(flagSampleIntervalMs) * time.Millisecond)
+			continue
+		}
+
+		samples, err := s.collector.Collect(nvidiasmiQueries)
 		if err != nil {
-			return fmt.Errorf("%s - %s", resp, err.Error())
+			_ = s.slog.Err(err.Error())
+		}
+
+		// no GPU collected is buffered as an empty snapshot, so that the
+		// export retires every GPU as fetchSnapshot does
+		if samples == nil {
+			samples = []gpuSample{}
 		}
 
-		_ = s.slog.Info("Metric descriptor created for " + fquery)
+		s.buffer.add(samples)
+
+		time.Sleep(time.Duration(flagSampleIntervalMs) * time.Millisecond)
+	}
+}
+
+// acquire returns false if a collection is still in flight, the tick
+// is skipped rather than piled up when nvidia-smi hangs
+func (s *service) acquire() bool {
+	if s.killedRunning() {
+		_ = s.slog.Warning("nvidia-smi killed on timeout still running, tick skipped")
+		return false
 	}
 
-	return nil
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	default:
+		_ = s.slog.Warning("Previous collection still running, tick skipped")
+		return false
+	}
 }
 
-func (s *service) fetchMetrics(gpuAmount int) {
-	fmi := flagFetchMetricsInterval
-	_ = s.slog.Info(fmt.Sprintf("Start fetching metrics every %d seconds", fmi))
+func (s *service) release() {
+	<-s.inflight
+}
 
-	// infinite loop with fetch metrics interval * second sleep
-	for {
+// killedRunning returns true while an nvidia-smi killed on timeout didn't
+// exit, e.g. stuck in the driver, no other nvidia-smi is started meanwhile
+func (s *service) killedRunning() bool {
+	return atomic.LoadInt64(&nvidiasmiKilled) > 0
+}
+
+// exportSamples publishes snapshots buffered since the last export,
+// per GPU values of sampled queries are their mean over the interval
+func (s *service) exportSamples() {
+	if !s.acquire() {
+		return
+	}
+	defer s.release()
 
-		// iterate over nvidia-smi queries
-		for _, query := range nvidiasmiQueries {
+	// nothing sampled yet or sampling paused, which doesn't mean no GPU
+	snapshots := s.buffer.drain()
+	if len(snapshots) == 0 {
+		_ = s.slog.Warning("No sample to export, tick skipped")
+		return
+	}
+
+	samples, windows := summarizeSnapshots(snapshots, nvidiasmiQueries)
+
+	// the last collection returned no GPU
+	if len(samples) == 0 {
+		s.publishNoGPU()
+		return
+	}
+
+	s.publishSnapshot(samples, windows)
+}
+
+// fetchSnapshot collects every query for every GPU at once and publishes them
+func (s *service) fetchSnapshot() {
+	if !s.acquire() {
+		return
+	}
+	defer s.release()
+
+	samples, err := s.collector.Collect(nvidiasmiQueries)
+	if err != nil {
+		_ = s.slog.Err(err.Error())
 
-			// iterate over gpu ids
-			for id := 0; id < gpuAmount; id++ {
-				go s.fetchMetric(query, id)
+		// a partial snapshot is published, missing GPUs are retired
+		if samples == nil {
+			s.publishNoGPU()
+			return
+		}
+	}
+
+	s.publishSnapshot(samples, nil)
+}
+
+// publishNoGPU publishes an empty inventory when no GPU could be
+// collected, e.g. once the driver is unloaded, so every GPU is retired
+func (s *service) publishNoGPU() {
+	b := newTimeSeriesBatch()
+
+	s.updateInventory(b, nil)
+
+	_ = s.sink.Write(b)
+}
+
+// publishSnapshot publishes per GPU and aggregate series from the same snapshot,
+// windows holds high frequency values of sampled queries if sampling is enabled,
+// every point of the snapshot is written in the same batch
+func (s *service) publishSnapshot(samples []gpuSample, windows map[windowKey][]float64) {
+	b := newTimeSeriesBatch()
+
+	s.updateInventory(b, samples)
+
+	// iterate over nvidia-smi queries
+	for _, query := range nvidiasmiQueries {
+		q := query
+		values := make([]float64, 0, len(samples))
+
+		// iterate over gpu samples, unavailable values are skipped
+		for _, sample := range samples {
+			value, ok := sample.Values[q.Name]
+			if !ok {
+				continue
 			}
 
-			// do a query for the gpus average
-			go s.fetchMetric(query, -1)
+			values = append(values, value)
+
+			labels := s.gpuSeriesLabels("gpu_"+fmt.Sprint(sample.ID), sample.BusID)
+
+			s.addTimeSeries(b, value, &q, labels)
+
+			if window, ok := windows[windowKey{query: q.Name, busID: sample.BusID}]; ok {
+				s.publishWindow(b, window, &q, labels)
+			}
 		}
 
-		time.Sleep(time.Duration(fmi) * time.Second)
+		// publish the gpus aggregates if at least one gpu reported a value
+		if len(values) == 0 {
+			continue
+		}
+
+		for _, a := range q.aggregates() {
+			s.addTimeSeries(b, aggregate(a, values), &q, s.gpuSeriesLabels(aggregateGPUIDs[a], "null"))
+		}
+	}
+
+	s.fetchProcesses(b)
+
+	if s.xid != nil {
+		s.publishXIDErrors(b, samples)
+	}
+
+	if flagEnableMIG {
+		s.fetchMIG(b, samples)
+	}
+
+	// written in background by each sink, the next collection does not wait for them
+	_ = s.sink.Write(b)
+}
+
+// sampledQueries returns queries published on top of a sampled query,
+// according to the export mode
+func sampledQueries(q *nvidiasmiQuery, mode string) []nvidiasmiQuery {
+	if mode == exportModeDistribution {
+		return []nvidiasmiQuery{q.distributionQuery()}
+	}
+
+	queries := make([]nvidiasmiQuery, 0, len(summaryStats))
+	for _, stat := range summaryStats {
+		queries = append(queries, q.summaryQuery(stat))
+	}
+
+	return queries
+}
+
+// publishWindow publishes summary statistics or distribution of high
+// frequency values of a GPU
+func (s *service) publishWindow(b *timeSeriesBatch, window []float64, q *nvidiasmiQuery, labels map[string]string) {
+	if flagExportMode == exportModeDistribution {
+		dq := q.distributionQuery()
+		s.addDistributionTimeSeries(b, window, &dq, labels)
+		return
+	}
+
+	for _, stat := range summaryStats {
+		sq := q.summaryQuery(stat)
+		s.addTimeSeries(b, summaryStat(stat, window), &sq, labels)
 	}
 }
 
-func (s *service) fetchMetric(q nvidiasmiQuery, id int) {
-	value, _, err := getGPUMetric(q.Name, id)
+// fetchMIG publishes MIG mode of each GPU and memory of each MIG device
+func (s *service) fetchMIG(b *timeSeriesBatch, samples []gpuSample) {
+	gpus, err := s.collector.CollectMIG(samples)
 	if err != nil {
 		_ = s.slog.Err(err.Error())
+		return
+	}
+
+	for _, gpu := range gpus {
+		enabled := float64(0)
+		if gpu.Enabled {
+			enabled = 1
+		}
+
+		s.addTimeSeries(b, enabled, &migEnabledQuery, s.gpuSeriesLabels("gpu_"+fmt.Sprint(gpu.ID), gpu.BusID))
+
+		for _, d := range gpu.Devices {
+			labels := s.gpuSeriesLabels("gpu_"+fmt.Sprint(gpu.ID), gpu.BusID)
+			labels["mig_profile"] = d.Profile
+			labels["gpu_instance_id"] = fmt.Sprint(d.GPUInstanceID)
+			labels["compute_instance_id"] = fmt.Sprint(d.ComputeInstanceID)
+
+			s.addTimeSeries(b, d.MemoryUsed, &migMemoryUsedQuery, labels)
+			s.addTimeSeries(b, d.MemoryTotal, &migMemoryTotalQuery, labels)
+			s.addTimeSeries(b, d.memoryUtilization(), &migMemoryUtilizationQuery, labels)
+		}
+	}
+}
+
+// publishXIDErrors publishes every XID error counter, errors are attributed
+// to a GPU of the snapshot by PCI bus id
+func (s *service) publishXIDErrors(b *timeSeriesBatch, samples []gpuSample) {
+	gpus := make(map[string]gpuSample, len(samples))
+	for _, sample := range samples {
+		gpus[normalizeBusID(sample.BusID)] = sample
+	}
+
+	for k, count := range s.xid.snapshot() {
+		gpuID, busID := "gpu_unknown", k.busID
+		if sample, ok := gpus[k.busID]; ok {
+			gpuID, busID = "gpu_"+fmt.Sprint(sample.ID), sample.BusID
+		}
+
+		labels := s.gpuSeriesLabels(gpuID, busID)
+		labels["xid"] = fmt.Sprint(k.code)
+
+		s.addTimeSeries(b, float64(count), &xidErrorsQuery, labels)
+	}
+}
+
+// updateInventory publishes GPU amount and inventory changes,
+// series of retired GPUs aren't published anymore
+func (s *service) updateInventory(b *timeSeriesBatch, samples []gpuSample) {
+	for _, c := range s.inventory.update(samples) {
+		_ = s.slog.Warning(fmt.Sprintf("GPU %d (%s) %s", c.sample.ID, c.sample.BusID, c.change))
+
+		if c.change == inventoryRemoved {
+			s.cumulative.forget("bus_id", c.sample.BusID)
+		}
 	}
 
-	if id >= 0 {
-		busID, err := getGPUbusID(id)
+	// static attributes are fetched once, then again only for new GPUs
+	if s.inventory.missingIdentity(samples) {
+		identities, err := s.collector.Identities()
 		if err != nil {
 			_ = s.slog.Err(err.Error())
+		} else {
+			s.inventory.setIdentities(identities)
 		}
+	}
+
+	s.addTimeSeries(b, float64(len(samples)), &deviceCountQuery, nil)
+
+	for k, count := range s.inventory.snapshot() {
+		s.addTimeSeries(b, float64(count), &inventoryChangesQuery, map[string]string{
+			"bus_id": k.busID,
+			"change": k.change,
+		})
+	}
+}
+
+// gpuSeriesLabels returns labels of a GPU series, with its cached static
+// attributes, or "null" for aggregates and unknown GPUs
+func (s *service) gpuSeriesLabels(gpuID string, busID string) map[string]string {
+	labels := map[string]string{
+		"gpu_id":   gpuID,
+		"bus_id":   busID,
+		"gpu_uuid": "null",
+		"serial":   "null",
+		"gpu_name": "null",
+	}
+
+	if id, ok := s.inventory.identity(busID); ok {
+		labels["gpu_uuid"] = id.UUID
+		labels["serial"] = id.Serial
+		labels["gpu_name"] = id.Name
+	}
+
+	return labels
+}
 
-		s.createTimeSeries(value, &q, fmt.Sprint(id), busID)
-	} else {
-		s.createTimeSeries(value, &q, "avg", "null")
-	}
-}
-
-func (s *service) createTimeSeries(value int64, q *nvidiasmiQuery, id string, busID string) {
-	now := time.Now()
-
-	fquery := q.gcpFormat()
-
-	req := &monitoringpb.CreateTimeSeriesRequest{
-		Name: "projects/" + s.projectID,
-		TimeSeries: []*monitoringpb.TimeSeries{
-			{
-				Metric: &metric.Metric{
-					Type: "custom.googleapis.com/gpu/" + fquery,
-					Labels: map[string]string{
-						"gpu_id":        "gpu_" + id,
-						"bus_id":        busID,
-						"instance_name": s.instanceName,
-					},
-				},
-				Resource: &monitoredres.MonitoredResource{
-					Type: "gce_instance",
-					Labels: map[string]string{
-						"instance_id": s.instanceID,
-						"zone":        s.zone,
-						"project_id":  s.projectID,
-					},
-				},
-				MetricKind: q.Kind,
-				ValueType:  q.Type,
-				Points: []*monitoringpb.Point{
-					{
-						Interval: &monitoringpb.TimeInterval{
-							EndTime: &timestamppb.Timestamp{
-								Seconds: int64(now.Unix()),
-								Nanos:   int32(now.Nanosecond()),
-							},
-						},
-						Value: &monitoringpb.TypedValue{
-							Value: &monitoringpb.TypedValue_Int64Value{
-								Int64Value: value,
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	ctx := context.Background()
-
-	err := s.CreateTimeSeries(ctx, req)
+// fetchProcesses publishes memory used by each running compute process,
+// exited processes are not published anymore so their series just end
+func (s *service) fetchProcesses(b *timeSeriesBatch) {
+	processes, err := s.collector.CollectProcesses()
 	if err != nil {
 		_ = s.slog.Err(err.Error())
+		return
+	}
+
+	for _, p := range processes {
+		s.addTimeSeries(b, p.UsedMemory, &processMemoryQuery, map[string]string{
+			"pid":          fmt.Sprint(p.PID),
+			"process_name": p.Name,
+			"gpu_uuid":     p.GPUUUID,
+		})
+	}
+}
+
+// pointValue converts a value according to the query value type
+func pointValue(value float64, q *nvidiasmiQuery) float64 {
+	switch q.Type {
+	case metric.MetricDescriptor_DOUBLE:
+		return value
+	case metric.MetricDescriptor_BOOL:
+		if value != 0 {
+			return 1
+		}
+		return 0
+	}
+
+	return math.Round(value)
+}
+
+// addTimeSeries adds a point to the batch, instance_name is added to labels
+func (s *service) addTimeSeries(b *timeSeriesBatch, value float64, q *nvidiasmiQuery, labels map[string]string) {
+	ts := s.newTimeSeries(b.end, q, labels)
+	ts.value = pointValue(value, q)
+
+	if q.Kind == metric.MetricDescriptor_CUMULATIVE {
+		ts.start = s.cumulative.startTime(ts.metricType, ts.labels, ts.value, b.end)
+	}
+
+	b.add(ts)
+}
+
+// addDistributionTimeSeries adds a distribution point built from values to the batch
+func (s *service) addDistributionTimeSeries(b *timeSeriesBatch, values []float64, q *nvidiasmiQuery, labels map[string]string) {
+	ts := s.newTimeSeries(b.end, q, labels)
+	ts.distribution = distributionValue(values, q)
+
+	b.add(ts)
+}
+
+func (s *service) newTimeSeries(now time.Time, q *nvidiasmiQuery, labels map[string]string) *timeSeries {
+	metricLabels := map[string]string{
+		"instance_name": s.instanceName,
+	}
+	for k, v := range labels {
+		metricLabels[k] = v
+	}
+
+	return &timeSeries{
+		metricType: metricType(q.gcpFormat()),
+		kind:       q.Kind,
+		valueType:  q.Type,
+		labels:     metricLabels,
+		end:        now,
 	}
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"log/syslog"
+	"sync"
+	"testing"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// recordingSink is a Sink keeping every written batch
+type recordingSink struct {
+	mu      sync.Mutex
+	batches []*timeSeriesBatch
+}
+
+func (r *recordingSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	return nil
+}
+
+func (r *recordingSink) Write(b *timeSeriesBatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.batches = append(r.batches, b)
+
+	return nil
+}
+
+func (r *recordingSink) Flush() error {
+	return nil
+}
+
+func (r *recordingSink) Close() error {
+	return nil
+}
+
+// find returns series of the last batch of a query matching labels
+func (r *recordingSink) find(q *nvidiasmiQuery, labels map[string]string) []*timeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.batches) == 0 {
+		return nil
+	}
+
+	var found []*timeSeries
+	for _, ts := range r.batches[len(r.batches)-1].series {
+		if ts.metricType != metricType(q.gcpFormat()) {
+			continue
+		}
+
+		matching := true
+		for k, v := range labels {
+			if ts.labels[k] != v {
+				matching = false
+			}
+		}
+
+		if matching {
+			found = append(found, ts)
+		}
+	}
+
+	return found
+}
+
+// newTestSyslog returns a syslog writer to a local port nothing listens to
+func newTestSyslog(t *testing.T) *syslog.Writer {
+	slog, err := syslog.Dial("udp", "127.0.0.1:5514", syslog.LOG_INFO, "gcp-gpu-metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return slog
+}
+
+func newTestService(t *testing.T, sink Sink) *service {
+	slog := newTestSyslog(t)
+
+	return &service{
+		slog:         slog,
+		collector:    &fakeCollector{fixturesPath: "hack/fixtures"},
+		cumulative:   newCumulativeTracker(),
+		inventory:    newInventory(),
+		buffer:       &sampleBuffer{},
+		inflight:     make(chan struct{}, 1),
+		sink:         sink,
+		instanceName: "test-vm",
+	}
+}
+
+func queryByName(t *testing.T, name string) *nvidiasmiQuery {
+	for i := range nvidiasmiQueries {
+		if nvidiasmiQueries[i].Name == name {
+			return &nvidiasmiQueries[i]
+		}
+	}
+
+	t.Fatalf("query %s not in catalog", name)
+	return nil
+}
+
+func TestPublishSnapshot(t *testing.T) {
+	sink := &recordingSink{}
+	s := newTestService(t, sink)
+
+	samples, err := s.collector.Collect(nvidiasmiQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.publishSnapshot(samples, nil)
+
+	tests := []struct {
+		name   string
+		query  *nvidiasmiQuery
+		labels map[string]string
+		want   float64
+	}{
+		{
+			name:   "device count",
+			query:  &deviceCountQuery,
+			labels: map[string]string{"instance_name": "test-vm"},
+			want:   2,
+		},
+		{
+			name:   "GPU temperature",
+			query:  queryByName(t, "temperature.gpu"),
+			labels: map[string]string{"gpu_id": "gpu_0", "bus_id": "00000000:00:04.0", "gpu_name": "NVIDIA A100-SXM4-40GB"},
+			want:   50,
+		},
+		{
+			name:   "max temperature",
+			query:  queryByName(t, "temperature.gpu"),
+			labels: map[string]string{"gpu_id": "gpu_max", "bus_id": "null"},
+			want:   60,
+		},
+		{
+			name:   "average temperature",
+			query:  queryByName(t, "temperature.gpu"),
+			labels: map[string]string{"gpu_id": "gpu_avg"},
+			want:   55,
+		},
+		{
+			name:   "process memory",
+			query:  &processMemoryQuery,
+			labels: map[string]string{"pid": "4317", "gpu_uuid": "GPU-1f0e4b6d-7c2a-4d8e-a5b1-9c3d2e7f6a01"},
+			want:   12288,
+		},
+		{
+			name:   "ECC errors",
+			query:  queryByName(t, "ecc.errors.corrected.aggregate.total"),
+			labels: map[string]string{"gpu_id": "gpu_1"},
+			want:   12,
+		},
+	}
+
+	for _, tt := range tests {
+		found := sink.find(tt.query, tt.labels)
+		if len(found) != 1 {
+			t.Errorf("%s: got %d series, want 1", tt.name, len(found))
+			continue
+		}
+
+		if found[0].value != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, found[0].value, tt.want)
+		}
+	}
+
+	// unavailable readings aren't published
+	if found := sink.find(queryByName(t, "fan.speed"), nil); len(found) != 0 {
+		t.Errorf("fan.speed published %d times, want 0", len(found))
+	}
+
+	// cumulative series have a start time, gauges don't
+	ecc := sink.find(queryByName(t, "ecc.errors.corrected.aggregate.total"), map[string]string{"gpu_id": "gpu_1"})
+	if len(ecc) == 1 && ecc[0].start.IsZero() {
+		t.Error("ECC errors published without start time")
+	}
+
+	temperature := sink.find(queryByName(t, "temperature.gpu"), map[string]string{"gpu_id": "gpu_0"})
+	if len(temperature) == 1 && !temperature[0].start.IsZero() {
+		t.Error("temperature published with a start time")
+	}
+}
+
+func TestPublishNoGPU(t *testing.T) {
+	sink := &recordingSink{}
+	s := newTestService(t, sink)
+
+	samples, err := s.collector.Collect(nvidiasmiQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.publishSnapshot(samples, nil)
+	s.publishNoGPU()
+
+	count := sink.find(&deviceCountQuery, nil)
+	if len(count) != 1 || count[0].value != 0 {
+		t.Fatalf("device count not published as 0: %v", count)
+	}
+
+	for _, busID := range []string{"00000000:00:04.0", "00000000:00:05.0"} {
+		removed := sink.find(&inventoryChangesQuery, map[string]string{"bus_id": busID, "change": inventoryRemoved})
+		if len(removed) != 1 || removed[0].value != 1 {
+			t.Errorf("GPU %s not counted as removed", busID)
+		}
+	}
+}
+
+func TestExportSamplesNothingSampled(t *testing.T) {
+	sink := &recordingSink{}
+	s := newTestService(t, sink)
+
+	// nothing sampled yet, e.g. right after start, the export is skipped
+	s.exportSamples()
+
+	if len(sink.batches) != 0 {
+		t.Fatalf("got %d batches without sample, want 0", len(sink.batches))
+	}
+
+	samples, err := s.collector.Collect(nvidiasmiQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.buffer.add(samples)
+	s.exportSamples()
+
+	if changes := sink.find(&inventoryChangesQuery, nil); len(changes) != 0 {
+		t.Errorf("got %d inventory changes on first samples, want 0", len(changes))
+	}
+
+	count := sink.find(&deviceCountQuery, nil)
+	if len(count) != 1 || count[0].value != 2 {
+		t.Fatalf("device count not published as 2: %v", count)
+	}
+
+	// a collection without GPU is buffered empty and retires every GPU
+	s.buffer.add([]gpuSample{})
+	s.exportSamples()
+
+	count = sink.find(&deviceCountQuery, nil)
+	if len(count) != 1 || count[0].value != 0 {
+		t.Fatalf("device count not published as 0: %v", count)
+	}
+
+	removed := sink.find(&inventoryChangesQuery, map[string]string{"change": inventoryRemoved})
+	if len(removed) != 2 {
+		t.Errorf("got %d GPUs removed, want 2", len(removed))
+	}
+}
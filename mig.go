@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// e.g. |   0  MIG 3g.20gb          9        1          4:4     |
+	migInstanceRegexp = regexp.MustCompile(`^\|\s+(\d+)\s+MIG\s+(\S+)\s+\d+\s+(\d+)\s+\d+:\d+\s+\|`)
+)
+
+// migGPU represents MIG mode and MIG devices of a single GPU
+type migGPU struct {
+	ID      int
+	BusID   string
+	Enabled bool
+	Devices []migDevice
+}
+
+// migDevice represents a MIG compute instance
+type migDevice struct {
+	Profile           string
+	GPUInstanceID     int
+	ComputeInstanceID int
+	MemoryUsed        float64
+	MemoryTotal       float64
+}
+
+// migProfileKey identifies a GPU instance in nvidia-smi mig -lgi output
+type migProfileKey struct {
+	gpuID         int
+	gpuInstanceID int
+}
+
+// nvidiasmiLog is the subset of nvidia-smi -q -x output related to MIG
+type nvidiasmiLog struct {
+	GPUs []struct {
+		ID      string `xml:"id,attr"`
+		MIGMode struct {
+			Current string `xml:"current_mig"`
+		} `xml:"mig_mode"`
+		MIGDevices []struct {
+			GPUInstanceID     string `xml:"gpu_instance_id"`
+			ComputeInstanceID string `xml:"compute_instance_id"`
+			FBMemoryUsage     struct {
+				Total string `xml:"total"`
+				Used  string `xml:"used"`
+			} `xml:"fb_memory_usage"`
+		} `xml:"mig_devices>mig_device"`
+	} `xml:"gpu"`
+}
+
+// parseMIG parses nvidia-smi -q -x and nvidia-smi mig -lgi outputs,
+// GPUs are matched with samples by PCI bus id since the XML has no index
+func parseMIG(qx []byte, lgi []byte, samples []gpuSample) ([]migGPU, error) {
+	var l nvidiasmiLog
+	if err := xml.Unmarshal(qx, &l); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int, len(samples))
+	for _, sample := range samples {
+		ids[normalizeBusID(sample.BusID)] = sample.ID
+	}
+
+	profiles := parseMIGProfiles(lgi)
+
+	gpus := make([]migGPU, 0, len(l.GPUs))
+
+	for _, g := range l.GPUs {
+		id, ok := ids[normalizeBusID(g.ID)]
+		if !ok {
+			continue
+		}
+
+		gpu := migGPU{
+			ID:      id,
+			BusID:   g.ID,
+			Enabled: g.MIGMode.Current == "Enabled",
+		}
+
+		for _, d := range g.MIGDevices {
+			giID, err := strconv.Atoi(strings.TrimSpace(d.GPUInstanceID))
+			if err != nil {
+				return nil, fmt.Errorf("invalid GPU instance id %q - %s", d.GPUInstanceID, err.Error())
+			}
+
+			ciID, err := strconv.Atoi(strings.TrimSpace(d.ComputeInstanceID))
+			if err != nil {
+				return nil, fmt.Errorf("invalid compute instance id %q - %s", d.ComputeInstanceID, err.Error())
+			}
+
+			device := migDevice{
+				Profile:           profiles[migProfileKey{gpuID: id, gpuInstanceID: giID}],
+				GPUInstanceID:     giID,
+				ComputeInstanceID: ciID,
+			}
+
+			if device.Profile == "" {
+				device.Profile = "unknown"
+			}
+
+			// memory values are like "19968 MiB", unavailable ones are skipped
+			total, terr := parseValue(firstField(d.FBMemoryUsage.Total), parserNumber)
+			used, uerr := parseValue(firstField(d.FBMemoryUsage.Used), parserNumber)
+			if terr != nil || uerr != nil {
+				continue
+			}
+
+			device.MemoryTotal = total
+			device.MemoryUsed = used
+
+			gpu.Devices = append(gpu.Devices, device)
+		}
+
+		gpus = append(gpus, gpu)
+	}
+
+	return gpus, nil
+}
+
+// parseMIGProfiles extracts GPU instances profiles from nvidia-smi mig -lgi output
+func parseMIGProfiles(o []byte) map[migProfileKey]string {
+	profiles := make(map[migProfileKey]string)
+
+	for _, line := range strings.Split(string(o), "\n") {
+		m := migInstanceRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+
+		gpuID, _ := strconv.Atoi(m[1])
+		giID, _ := strconv.Atoi(m[3])
+
+		profiles[migProfileKey{gpuID: gpuID, gpuInstanceID: giID}] = m[2]
+	}
+
+	return profiles
+}
+
+// firstField returns the value of a reading with unit like "19968 MiB"
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return fields[0]
+}
+
+// memoryUtilization returns the percent of memory used by a MIG device
+func (d *migDevice) memoryUtilization() float64 {
+	if d.MemoryTotal == 0 {
+		return 0
+	}
+
+	return d.MemoryUsed / d.MemoryTotal * 100
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMIGProfiles(t *testing.T) {
+	o, err := ioutil.ReadFile(filepath.Join("hack", "fixtures", fakeMIGListGIFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[migProfileKey]string{
+		{gpuID: 0, gpuInstanceID: 1}: "3g.20gb",
+		{gpuID: 0, gpuInstanceID: 2}: "3g.20gb",
+	}
+
+	if got := parseMIGProfiles(o); !reflect.DeepEqual(got, want) {
+		t.Errorf("got profiles %v, want %v", got, want)
+	}
+
+	if got := parseMIGProfiles([]byte("No GPU instances found: Not Found\n")); len(got) != 0 {
+		t.Errorf("got profiles %v without GPU instance", got)
+	}
+}
+
+func TestParseMIG(t *testing.T) {
+	c := &fakeCollector{fixturesPath: filepath.Join("hack", "fixtures")}
+
+	samples, err := c.Collect(nvidiasmiQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gpus, err := c.CollectMIG(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []migGPU{
+		{
+			ID:      0,
+			BusID:   "00000000:00:04.0",
+			Enabled: true,
+			Devices: []migDevice{
+				{Profile: "3g.20gb", GPUInstanceID: 1, ComputeInstanceID: 0, MemoryUsed: 10146, MemoryTotal: 19968},
+				{Profile: "3g.20gb", GPUInstanceID: 2, ComputeInstanceID: 0, MemoryUsed: 11, MemoryTotal: 19968},
+			},
+		},
+		{
+			ID:    1,
+			BusID: "00000000:00:05.0",
+		},
+	}
+
+	if !reflect.DeepEqual(gpus, want) {
+		t.Errorf("got MIG GPUs %+v, want %+v", gpus, want)
+	}
+
+	// nvidia-smi doesn't report utilization of a GPU with MIG enabled
+	if v, ok := samples[0].Values["utilization.gpu"]; ok {
+		t.Errorf("utilization.gpu = %v on MIG GPU, want it skipped", v)
+	}
+}
+
+func TestParseMIGUnknownGPU(t *testing.T) {
+	qx, err := ioutil.ReadFile(filepath.Join("hack", "fixtures", fakeQueryXMLFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GPUs missing from samples are skipped, profiles default to unknown
+	samples := []gpuSample{{ID: 3, BusID: "00000000:00:04.0"}}
+
+	gpus, err := parseMIG(qx, nil, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gpus) != 1 || gpus[0].ID != 3 {
+		t.Fatalf("got MIG GPUs %+v, want GPU 3 only", gpus)
+	}
+
+	for _, d := range gpus[0].Devices {
+		if d.Profile != "unknown" {
+			t.Errorf("GPU instance %d has profile %q, want unknown", d.GPUInstanceID, d.Profile)
+		}
+	}
+
+	if _, err := parseMIG([]byte("<nvidia_smi_log"), nil, samples); err == nil {
+		t.Error("parseMIG succeeded on truncated XML")
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -16,6 +20,16 @@ type nvidiasmiQuery struct {
 	Kind        metric.MetricDescriptor_MetricKind
 	Type        metric.MetricDescriptor_ValueType
 	Unit        string
+	// Scale multiplies every value when not 0, e.g. to convert MiB into GiB
+	Scale float64
+	// Parser is the name of the parser for non numeric values, empty for numbers
+	Parser string
+	// Aggregates are computed over every GPU, if nil mean is computed for
+	// gauge numbers and nothing for other queries
+	Aggregates []string
+	// Buckets are explicit bounds of the distribution exported in
+	// distribution mode, if empty exponential buckets are used
+	Buckets []float64
 }
 
 var (
@@ -28,6 +42,7 @@ var (
 			Kind:        metric.MetricDescriptor_GAUGE,
 			Type:        metric.MetricDescriptor_INT64,
 			Unit:        "1/{degres C}",
+			Aggregates:  []string{aggregateMean, aggregateMax},
 		},
 		{
 			Name:        "utilization.gpu",
@@ -35,6 +50,7 @@ var (
 			Kind:        metric.MetricDescriptor_GAUGE,
 			Type:        metric.MetricDescriptor_INT64,
 			Unit:        "%",
+			Aggregates:  []string{aggregateMean, aggregateMax},
 		},
 		{
 			Name:        "utilization.memory",
@@ -49,6 +65,7 @@ var (
 			Kind:        metric.MetricDescriptor_GAUGE,
 			Type:        metric.MetricDescriptor_INT64,
 			Unit:        "MiBy",
+			Aggregates:  []string{aggregateMean, aggregateSum},
 		},
 		{
 			Name:        "memory.free",
@@ -56,6 +73,7 @@ var (
 			Kind:        metric.MetricDescriptor_GAUGE,
 			Type:        metric.MetricDescriptor_INT64,
 			Unit:        "MiBy",
+			Aggregates:  []string{aggregateMean, aggregateSum},
 		},
 		{
 			Name:        "memory.used",
@@ -63,23 +81,301 @@ var (
 			Kind:        metric.MetricDescriptor_GAUGE,
 			Type:        metric.MetricDescriptor_INT64,
 			Unit:        "MiBy",
+			Aggregates:  []string{aggregateMean, aggregateSum},
+		},
+		{
+			Name:        "power.draw",
+			DisplayName: "Power Draw GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_DOUBLE,
+			Unit:        "W",
+		},
+		{
+			Name:        "power.limit",
+			DisplayName: "Power Limit GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_DOUBLE,
+			Unit:        "W",
+		},
+		{
+			Name:        "enforced.power.limit",
+			DisplayName: "Enforced Power Limit GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_DOUBLE,
+			Unit:        "W",
+		},
+		{
+			Name:        "clocks.sm",
+			DisplayName: "SM Clock GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "MHz",
+		},
+		{
+			Name:        "clocks.mem",
+			DisplayName: "Memory Clock GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "MHz",
+		},
+		{
+			Name:        "clocks.max.sm",
+			DisplayName: "Max SM Clock GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "MHz",
+		},
+		{
+			Name:        "fan.speed",
+			DisplayName: "Fan Speed GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "%",
+		},
+		{
+			Name:        "pstate",
+			DisplayName: "Performance State GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
+			Parser:      parserPState,
+		},
+		{
+			Name:        "clocks_throttle_reasons.active",
+			DisplayName: "Active Throttle Reasons GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
+			Parser:      parserBitmask,
+		},
+		{
+			Name:        "clocks_throttle_reasons.gpu_idle",
+			DisplayName: "Throttle Reason Idle GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.applications_clocks_setting",
+			DisplayName: "Throttle Reason Applications Clocks Setting GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.sw_power_cap",
+			DisplayName: "Throttle Reason SW Power Cap GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.hw_slowdown",
+			DisplayName: "Throttle Reason HW Slowdown GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.hw_thermal_slowdown",
+			DisplayName: "Throttle Reason HW Thermal Slowdown GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.hw_power_brake_slowdown",
+			DisplayName: "Throttle Reason HW Power Brake Slowdown GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.sw_thermal_slowdown",
+			DisplayName: "Throttle Reason SW Thermal Slowdown GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "clocks_throttle_reasons.sync_boost",
+			DisplayName: "Throttle Reason Sync Boost GPU",
+			Kind:        metric.MetricDescriptor_GAUGE,
+			Type:        metric.MetricDescriptor_BOOL,
+			Unit:        "1",
+			Parser:      parserActive,
+		},
+		{
+			Name:        "ecc.errors.corrected.volatile.total",
+			DisplayName: "Corrected Volatile ECC Errors GPU",
+			Kind:        metric.MetricDescriptor_CUMULATIVE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
+		},
+		{
+			Name:        "ecc.errors.uncorrected.volatile.total",
+			DisplayName: "Uncorrected Volatile ECC Errors GPU",
+			Kind:        metric.MetricDescriptor_CUMULATIVE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
+		},
+		{
+			Name:        "ecc.errors.corrected.aggregate.total",
+			DisplayName: "Corrected Aggregate ECC Errors GPU",
+			Kind:        metric.MetricDescriptor_CUMULATIVE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
+		},
+		{
+			Name:        "ecc.errors.uncorrected.aggregate.total",
+			DisplayName: "Uncorrected Aggregate ECC Errors GPU",
+			Kind:        metric.MetricDescriptor_CUMULATIVE,
+			Type:        metric.MetricDescriptor_INT64,
+			Unit:        "1",
 		},
 	}
+
+	// processMemoryQuery describes the per compute process memory metric,
+	// it's fetched with --query-compute-apps and not part of nvidiasmiQueries
+	processMemoryQuery = nvidiasmiQuery{
+		Name:        "process.memory.used",
+		DisplayName: "Process Memory Used GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "MiBy",
+	}
+
+	// xidErrorsQuery describes the XID errors counter, it's read
+	// from the kernel log and not part of nvidiasmiQueries
+	xidErrorsQuery = nvidiasmiQuery{
+		Name:        "xid.errors",
+		DisplayName: "XID Errors GPU",
+		Kind:        metric.MetricDescriptor_CUMULATIVE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "1",
+	}
+
+	// MIG related metrics are fetched with nvidia-smi -q -x
+	// and not part of nvidiasmiQueries
+	migEnabledQuery = nvidiasmiQuery{
+		Name:        "mig.enabled",
+		DisplayName: "MIG Mode Enabled GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_BOOL,
+		Unit:        "1",
+	}
+	migMemoryUsedQuery = nvidiasmiQuery{
+		Name:        "mig.memory.used",
+		DisplayName: "MIG Device Memory Used GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "MiBy",
+	}
+	migMemoryTotalQuery = nvidiasmiQuery{
+		Name:        "mig.memory.total",
+		DisplayName: "MIG Device Memory Total GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "MiBy",
+	}
+	migMemoryUtilizationQuery = nvidiasmiQuery{
+		Name:        "mig.memory.utilization",
+		DisplayName: "MIG Device Memory Utilization GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_DOUBLE,
+		Unit:        "%",
+	}
+
+	// deviceCountQuery describes the amount of GPUs seen in each snapshot
+	deviceCountQuery = nvidiasmiQuery{
+		Name:        "device.count",
+		DisplayName: "Device Count GPU",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "1",
+	}
+
+	// collectorTimeoutsQuery describes the counter of nvidia-smi calls killed on timeout
+	collectorTimeoutsQuery = nvidiasmiQuery{
+		Name:        "collector.timeouts",
+		DisplayName: "Collector Timeouts GPU",
+		Kind:        metric.MetricDescriptor_CUMULATIVE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "1",
+	}
+
+	// inventoryChangesQuery describes the counter of GPUs appearing or vanishing
+	inventoryChangesQuery = nvidiasmiQuery{
+		Name:        "inventory.changes",
+		DisplayName: "Inventory Changes GPU",
+		Kind:        metric.MetricDescriptor_CUMULATIVE,
+		Type:        metric.MetricDescriptor_INT64,
+		Unit:        "1",
+	}
 )
 
 func (q *nvidiasmiQuery) gcpFormat() string {
 	return strings.ReplaceAll(q.Name, ".", "_")
 }
 
+// aggregates returns aggregates to compute over every GPU, counters,
+// booleans and bitmasks have no default aggregate
+func (q *nvidiasmiQuery) aggregates() []string {
+	if q.Aggregates != nil {
+		return q.Aggregates
+	}
+
+	if q.Kind == metric.MetricDescriptor_GAUGE &&
+		q.Type != metric.MetricDescriptor_BOOL &&
+		q.Parser != parserBitmask {
+		return []string{aggregateMean}
+	}
+
+	return nil
+}
+
+var (
+	helpQueryFieldRegexp = regexp.MustCompile(`"([^"]+)"`)
+
+	errNotAvailable = errors.New("value not available")
+
+	// errInsufficientPermissions is returned when nvidia-smi lacks privileges
+	errInsufficientPermissions = errors.New("insufficient permissions")
+
+	// notAvailableValues are the sentinels nvidia-smi prints
+	// instead of a reading
+	notAvailableValues = []string{
+		"N/A",
+		"[N/A]",
+		"[Not Supported]",
+		"[Unknown Error]",
+		"[GPU is lost]",
+		"[Insufficient Permissions]",
+	}
+)
+
 const (
-	queryFormat string = "-u --format=csv,noheader"
+	// value parsers, see nvidiasmiQuery.Parser
+
+	parserNumber  string = ""
+	parserPState  string = "pstate"
+	parserActive  string = "active"
+	parserBitmask string = "bitmask"
+)
+
+const (
+	batchQueryFormat string = "--format=csv,nounits"
 )
 
 func getGPUAmount() (int, error) {
-	o, err := exec.Command("/bin/sh",
-		"-c",
-		"nvidia-smi --query-gpu=index "+queryFormat,
-	).Output()
+	o, err := nvidiasmiOutput("--query-gpu=index", "--format=csv,noheader")
 	if err != nil {
 		return 0, fmt.Errorf("%s - %s", err.Error(), string(o))
 	}
@@ -92,74 +388,369 @@ func getGPUAmount() (int, error) {
 	return amount, nil
 }
 
-func getGPUbusID(id int) (string, error) {
-	o, err := exec.Command("/bin/sh",
-		"-c",
-		fmt.Sprintf("nvidia-smi --query-gpu=pci.bus_id --id=%d "+queryFormat,
-			id),
-	).Output()
+// nvidiasmiCollector is the Collector fetching samples from
+// the nvidia-smi binary installed on the instance
+type nvidiasmiCollector struct{}
+
+func (c *nvidiasmiCollector) GPUAmount() (int, error) {
+	return getGPUAmount()
+}
+
+// Collect fetches every query for every GPU with a single nvidia-smi call,
+// when a GPU is lost nvidia-smi fails but healthy GPUs samples are still returned
+func (c *nvidiasmiCollector) Collect(queries []nvidiasmiQuery) ([]gpuSample, error) {
+	fields := queryFields(queries)
+
+	o, err := nvidiasmiOutput("--query-gpu="+strings.Join(fields, ","), batchQueryFormat)
+	if err == errCommandTimeout {
+		return nil, err
+	}
+
+	samples, perr := parseGPUSamples(o, queries, fieldColumns(fields))
+
+	if err != nil {
+		return samples, fmt.Errorf("%s - %s", err.Error(), string(o))
+	}
+
+	return samples, perr
+}
+
+// queryFields returns the --query-gpu fields needed to build samples
+func queryFields(queries []nvidiasmiQuery) []string {
+	fields := []string{"index", "pci.bus_id"}
+	for _, q := range queries {
+		fields = append(fields, q.Name)
+	}
+
+	return fields
+}
+
+// fieldColumns maps each field to its position, nvidia-smi prints canonical
+// names in header (e.g. clocks.current.sm for clocks.sm), so columns
+// are matched by position
+func fieldColumns(fields []string) map[string]int {
+	columns := make(map[string]int, len(fields))
+	for i, f := range fields {
+		columns[f] = i
+	}
+
+	return columns
+}
+
+// Identities fetches static attributes of every GPU
+func (c *nvidiasmiCollector) Identities() ([]gpuIdentity, error) {
+	o, err := nvidiasmiOutput("--query-gpu=pci.bus_id,uuid,serial,name", batchQueryFormat)
 	if err != nil {
-		return "", fmt.Errorf("%s - %s", err.Error(), string(o))
+		return nil, fmt.Errorf("%s - %s", err.Error(), string(o))
 	}
 
-	return strings.Split(string(o), "\n")[0], nil
+	return parseIdentities(o, fieldColumns([]string{"pci.bus_id", "uuid", "serial", "name"}))
 }
 
-func getGPUMetric(query string, id int) (int64, string, error) {
-	var cmd string
+// parseIdentities parses a nvidia-smi CSV output with header holding GPUs
+// static attributes, columns maps fields to their position, if nil it's built
+// from header
+func parseIdentities(o []byte, columns map[string]int) ([]gpuIdentity, error) {
+	r := csv.NewReader(bytes.NewReader(o))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
 
-	if id >= 0 {
-		cmd = fmt.Sprintf("nvidia-smi --id=%d --query-gpu=%s "+queryFormat,
-			id, query)
-	} else {
-		cmd = fmt.Sprintf("nvidia-smi --query-gpu=%s "+queryFormat,
-			query)
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
 	}
 
-	o, err := exec.Command("/bin/sh",
-		"-c",
-		cmd,
-	).Output()
+	if len(records) <= 1 {
+		return nil, nil
+	}
+
+	if columns == nil {
+		columns = headerColumns(records[0])
+	}
+
+	// missing attributes are kept empty
+	field := func(record []string, name string) string {
+		column, ok := columns[name]
+		if !ok || column >= len(record) {
+			return ""
+		}
+
+		return record[column]
+	}
+
+	identities := make([]gpuIdentity, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		if len(record) != len(records[0]) {
+			continue
+		}
+
+		identities = append(identities, gpuIdentity{
+			BusID:  field(record, "pci.bus_id"),
+			UUID:   field(record, "uuid"),
+			Serial: field(record, "serial"),
+			Name:   field(record, "name"),
+		})
+	}
+
+	return identities, nil
+}
+
+// CollectProcesses fetches GPU memory used by every compute process
+func (c *nvidiasmiCollector) CollectProcesses() ([]processSample, error) {
+	o, err := nvidiasmiOutput("--query-compute-apps=pid,process_name,gpu_uuid,used_memory", batchQueryFormat)
 	if err != nil {
-		return 0, "", err
+		return nil, fmt.Errorf("%s - %s", err.Error(), string(o))
 	}
 
-	lines := strings.Split(string(o), "\n")
+	return parseProcessSamples(o)
+}
 
-	amount := int64(len(lines) - 1)
+// CollectMIG fetches MIG devices from nvidia-smi -q -x and their
+// profile from nvidia-smi mig -lgi
+func (c *nvidiasmiCollector) CollectMIG(samples []gpuSample) ([]migGPU, error) {
+	qx, err := nvidiasmiOutput("-q", "-x")
+	if err != nil {
+		return nil, fmt.Errorf("%s - %s", err.Error(), string(qx))
+	}
 
-	if amount == 0 {
-		return 0, "", errors.New("Can't fetch metrics on 0 GPUs")
+	// fails without MIG enabled GPU, profiles are unknown then
+	lgi, _ := nvidiasmiOutput("mig", "-lgi")
+
+	return parseMIG(qx, lgi, samples)
+}
+
+// parseProcessSamples parses nvidia-smi --query-compute-apps CSV output with header,
+// columns must be pid, process_name, gpu_uuid and used_memory
+func parseProcessSamples(o []byte) ([]processSample, error) {
+	r := csv.NewReader(bytes.NewReader(o))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = 4
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	// no compute process running
+	if len(records) <= 1 {
+		return nil, nil
+	}
+
+	samples := make([]processSample, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		pid, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid process pid %q - %s", record[0], err.Error())
+		}
+
+		// memory is unavailable without enough privileges, skip the process
+		v, err := parseValue(record[3], parserNumber)
+		if err != nil {
+			continue
+		}
+
+		samples = append(samples, processSample{
+			PID:        pid,
+			Name:       record[1],
+			GPUUUID:    record[2],
+			UsedMemory: v,
+		})
+	}
+
+	return samples, nil
+}
+
+// SupportedQueries returns every field listed by nvidia-smi --help-query-gpu
+func (c *nvidiasmiCollector) SupportedQueries() ([]string, error) {
+	o, err := nvidiasmiOutput("--help-query-gpu")
+	if err != nil {
+		return nil, fmt.Errorf("%s - %s", err.Error(), string(o))
+	}
+
+	return parseHelpQueryGPU(o), nil
+}
+
+// parseHelpQueryGPU extracts field names and their aliases from
+// nvidia-smi --help-query-gpu output, fields are quoted at line beginning
+// e.g. "pci.bus_id" or "gpu_bus_id"
+func parseHelpQueryGPU(o []byte) []string {
+	var fields []string
+
+	for _, line := range strings.Split(string(o), "\n") {
+		if !strings.HasPrefix(line, "\"") {
+			continue
+		}
+
+		for _, m := range helpQueryFieldRegexp.FindAllStringSubmatch(line, -1) {
+			fields = append(fields, m[1])
+		}
+	}
+
+	return fields
+}
+
+// parseGPUSamples parses a multi-column nvidia-smi CSV output with header,
+// columns maps query names to their position, if nil it's built from header.
+// index and pci.bus_id columns are mandatory
+func parseGPUSamples(o []byte, queries []nvidiasmiQuery, columns map[string]int) ([]gpuSample, error) {
+	r := csv.NewReader(bytes.NewReader(o))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
 	}
 
-	//delete last blank line
-	lines = lines[:amount]
+	// no GPU at all, e.g. all of them fell off the bus
+	if len(records) <= 1 {
+		return nil, nil
+	}
+
+	if columns == nil {
+		columns = headerColumns(records[0])
+	}
 
-	sumValues := int64(0)
-	unit := ""
+	samples := make([]gpuSample, 0, len(records)-1)
 
-	for _, line := range lines {
-		elem := strings.Split(line, " ")
-		if len(elem) >= 2 {
-			unit = elem[1]
+	for _, record := range records[1:] {
+		// skip error messages printed among GPU lines, like
+		// "Unable to determine the device handle for GPU 0000:00:04.0: GPU is lost"
+		if len(record) != len(records[0]) {
+			continue
 		}
-		v, err := strconv.ParseInt(elem[0], 10, 64)
+
+		sample, err := parseGPURecord(record, queries, columns)
 		if err != nil {
-			v = 0
+			return nil, err
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+// parseGPURecord parses a single GPU line of nvidia-smi CSV output
+func parseGPURecord(record []string, queries []nvidiasmiQuery, columns map[string]int) (gpuSample, error) {
+	indexColumn, ok := columns["index"]
+	if !ok || indexColumn >= len(record) {
+		return gpuSample{}, errors.New("index column missing from nvidia-smi output")
+	}
+
+	busIDColumn, ok := columns["pci.bus_id"]
+	if !ok || busIDColumn >= len(record) {
+		return gpuSample{}, errors.New("pci.bus_id column missing from nvidia-smi output")
+	}
+
+	id, err := strconv.Atoi(record[indexColumn])
+	if err != nil {
+		return gpuSample{}, fmt.Errorf("invalid GPU index %q - %s", record[indexColumn], err.Error())
+	}
+
+	sample := gpuSample{
+		ID:     id,
+		BusID:  record[busIDColumn],
+		Values: make(map[string]float64, len(queries)),
+	}
+
+	for _, q := range queries {
+		column, ok := columns[q.Name]
+		if !ok || column >= len(record) {
+			continue
+		}
+
+		// unavailable or invalid readings are skipped, never published as 0
+		v, err := parseValue(record[column], q.Parser)
+		if err != nil {
+			continue
+		}
+
+		if q.Scale != 0 {
+			v *= q.Scale
+		}
+		sample.Values[q.Name] = v
+	}
+
+	return sample, nil
+}
+
+// headerColumns maps each nvidia-smi CSV column name to its position,
+// units like " [%]" are removed
+func headerColumns(header []string) map[string]int {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.SplitN(strings.TrimSpace(name), " ", 2)[0]] = i
+	}
+
+	return columns
+}
+
+// parseValue parses a single nvidia-smi reading with the given parser
+func parseValue(raw string, parser string) (float64, error) {
+	raw = strings.TrimSpace(raw)
+
+	for _, na := range notAvailableValues {
+		if strings.EqualFold(raw, na) {
+			return 0, errNotAvailable
 		}
-		sumValues += v
 	}
 
-	value := sumValues / amount
+	switch parser {
+	case parserNumber:
+		return strconv.ParseFloat(raw, 64)
+	case parserPState:
+		return parsePState(raw)
+	case parserActive:
+		return parseActive(raw)
+	case parserBitmask:
+		return parseBitmask(raw)
+	default:
+		return 0, fmt.Errorf("unknown parser %q", parser)
+	}
+}
+
+// parsePState converts a performance state from P0 (max performance)
+// to P15 (min performance) into its number
+func parsePState(raw string) (float64, error) {
+	if !strings.HasPrefix(raw, "P") {
+		return 0, fmt.Errorf("invalid performance state %q", raw)
+	}
+
+	v, err := strconv.ParseUint(raw[1:], 10, 8)
+	if err != nil || v > 15 {
+		return 0, fmt.Errorf("invalid performance state %q", raw)
+	}
 
-	return value, unit, nil
+	return float64(v), nil
+}
+
+// parseActive converts a throttle reason state into 1 if active, 0 otherwise
+func parseActive(raw string) (float64, error) {
+	switch raw {
+	case "Active":
+		return 1, nil
+	case "Not Active":
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid active state %q", raw)
+	}
+}
+
+// parseBitmask converts an hexadecimal bitmask like 0x0000000000000004
+func parseBitmask(raw string) (float64, error) {
+	v, err := strconv.ParseUint(raw, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bitmask %q", raw)
+	}
+
+	return float64(v), nil
 }
 
 func isNvidiasmiExist() error {
-	o, err := exec.Command("/bin/sh",
-		"-c",
-		"nvidia-smi --list-gpus",
-	).CombinedOutput()
+	o, err := nvidiasmiCombinedOutput("--list-gpus")
 	if err != nil {
 		return fmt.Errorf("%s - %s", err.Error(), string(o))
 	}
@@ -168,15 +759,27 @@ func isNvidiasmiExist() error {
 }
 
 // enablePMNvidiasmi aims to enable persistence mod on nvidia smi
-// to prevent 100% gpu usage on one GPU at each query
+// to prevent 100% gpu usage on one GPU at each query, it requires root
+// or a capability granted to the process, e.g. CAP_SYS_ADMIN in a container
 func enablePMNvidiasmi() error {
-	o, err := exec.Command("/bin/sh",
-		"-c",
-		"sudo nvidia-smi -pm 1",
-	).Output()
+	o, err := nvidiasmiCombinedOutput("-pm", "1")
 	if err != nil {
+		if isPermissionDenied(err, o) {
+			return fmt.Errorf("nvidia-smi persistence mod requires root or a capability granted to the process, e.g. CAP_SYS_ADMIN, running as uid %d: %w - %s", os.Geteuid(), errInsufficientPermissions, strings.TrimSpace(string(o)))
+		}
+
 		return fmt.Errorf("%s - %s", err.Error(), string(o))
 	}
 
 	return nil
 }
+
+// isPermissionDenied returns true if nvidia-smi failed for lack of privileges,
+// nvidia-smi exits with code 4 and reports insufficient permissions
+func isPermissionDenied(err error, o []byte) bool {
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 4 {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(string(o)), "insufficient permissions")
+}
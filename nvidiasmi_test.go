@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		raw     string
+		parser  string
+		want    float64
+		wantErr bool
+	}{
+		{raw: "87", parser: parserNumber, want: 87},
+		{raw: " 171.34 ", parser: parserNumber, want: 171.34},
+		{raw: "[N/A]", parser: parserNumber, wantErr: true},
+		{raw: "[Not Supported]", parser: parserNumber, wantErr: true},
+		{raw: "n/a", parser: parserNumber, wantErr: true},
+		{raw: "abc", parser: parserNumber, wantErr: true},
+		{raw: "P0", parser: parserPState, want: 0},
+		{raw: "P8", parser: parserPState, want: 8},
+		{raw: "8", parser: parserPState, wantErr: true},
+		{raw: "Active", parser: parserActive, want: 1},
+		{raw: "Not Active", parser: parserActive, want: 0},
+		{raw: "Idle", parser: parserActive, wantErr: true},
+		{raw: "0x0000000000000004", parser: parserBitmask, want: 4},
+		{raw: "0x", parser: parserBitmask, wantErr: true},
+		{raw: "1", parser: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseValue(tt.raw, tt.parser)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseValue(%q, %q) = %v, want error", tt.raw, tt.parser, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseValue(%q, %q) failed: %s", tt.raw, tt.parser, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("parseValue(%q, %q) = %v, want %v", tt.raw, tt.parser, got, tt.want)
+		}
+	}
+
+	if _, err := parseValue("[N/A]", parserNumber); err != errNotAvailable {
+		t.Errorf("parseValue([N/A]) error = %v, want %v", err, errNotAvailable)
+	}
+}
+
+func TestParseGPUSamples(t *testing.T) {
+	o, err := ioutil.ReadFile(filepath.Join("hack", "fixtures", fakeQueryGPUFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := parseGPUSamples(o, nvidiasmiQueries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+
+	tests := []struct {
+		gpu   int
+		query string
+		want  float64
+	}{
+		{gpu: 0, query: "temperature.gpu", want: 50},
+		{gpu: 1, query: "temperature.gpu", want: 60},
+		{gpu: 0, query: "power.draw", want: 171.34},
+		{gpu: 1, query: "memory.used", want: 12290},
+		{gpu: 0, query: "pstate", want: 0},
+		{gpu: 1, query: "clocks_throttle_reasons.active", want: 4},
+		{gpu: 1, query: "clocks_throttle_reasons.sw_power_cap", want: 1},
+		{gpu: 0, query: "clocks_throttle_reasons.gpu_idle", want: 0},
+		{gpu: 1, query: "ecc.errors.corrected.aggregate.total", want: 12},
+	}
+
+	for _, tt := range tests {
+		got, ok := samples[tt.gpu].Values[tt.query]
+		if !ok {
+			t.Errorf("GPU %d: %s missing", tt.gpu, tt.query)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("GPU %d: %s = %v, want %v", tt.gpu, tt.query, got, tt.want)
+		}
+	}
+
+	if samples[1].ID != 1 || samples[1].BusID != "00000000:00:05.0" {
+		t.Errorf("GPU 1 identified as %d %s", samples[1].ID, samples[1].BusID)
+	}
+
+	// unavailable readings are skipped, never published as 0
+	if v, ok := samples[0].Values["fan.speed"]; ok {
+		t.Errorf("fan.speed = %v, want it skipped", v)
+	}
+}
+
+func TestParseGPUSamplesLostGPU(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   int
+	}{
+		{
+			name:   "header only",
+			output: "index, pci.bus_id, temperature.gpu\n",
+			want:   0,
+		},
+		{
+			name: "lost GPU",
+			output: "index, pci.bus_id, temperature.gpu\n" +
+				"Unable to determine the device handle for GPU 0000:00:04.0: GPU is lost\n" +
+				"1, 00000000:00:05.0, 60\n",
+			want: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		samples, err := parseGPUSamples([]byte(tt.output), nvidiasmiQueries, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if len(samples) != tt.want {
+			t.Errorf("%s: got %d samples, want %d", tt.name, len(samples), tt.want)
+		}
+	}
+}
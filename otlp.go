@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/json"
+
+	otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpHTTPPath     = "/v1/metrics"
+	otlpTimeout      = 10 * time.Second
+
+	otlpScopeName = "gcp-gpu-metrics"
+
+	// aggregation temporalities of sums and histograms
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// otlpSink pushes every batch to an OpenTelemetry collector over
+// OTLP/gRPC or OTLP/HTTP with JSON encoding, messages are encoded by hand
+// to avoid depending on OpenTelemetry modules
+type otlpSink struct {
+	protocol    string
+	endpoint    string
+	conn        *grpc.ClientConn
+	client      *http.Client
+	resource    map[string]string
+	descriptors map[string]*metric.MetricDescriptor
+}
+
+// otlpMetric is a metric of an export request, gauges, sums and
+// histograms share the same points
+type otlpMetric struct {
+	name        string
+	description string
+	unit        string
+	kind        string
+	monotonic   bool
+	temporality int
+	points      []otlpPoint
+}
+
+type otlpPoint struct {
+	attributes map[string]string
+	start      uint64
+	end        uint64
+
+	isInt       bool
+	intValue    int64
+	doubleValue float64
+
+	count        uint64
+	sum          float64
+	bucketCounts []uint64
+	bounds       []float64
+}
+
+const (
+	otlpKindGauge     = "gauge"
+	otlpKindSum       = "sum"
+	otlpKindHistogram = "histogram"
+)
+
+// newOTLPSink returns a sink to endpoint, a host:port for gRPC or
+// a base URL for HTTP, resource attributes are set from the instance identity
+func newOTLPSink(s *service, protocol string, endpoint string, insecure bool) (*otlpSink, error) {
+	e := &otlpSink{
+		protocol:    protocol,
+		endpoint:    endpoint,
+		resource:    otlpResource(s),
+		descriptors: map[string]*metric.MetricDescriptor{},
+	}
+
+	switch protocol {
+	case otlpProtocolGRPC:
+		opt := grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
+		if insecure {
+			opt = grpc.WithInsecure()
+		}
+
+		// the connection is established lazily
+		conn, err := grpc.Dial(endpoint, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		e.conn = conn
+	case otlpProtocolHTTP:
+		e.client = &http.Client{Timeout: otlpTimeout}
+		e.endpoint = strings.TrimSuffix(endpoint, "/") + otlpHTTPPath
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, %q or %q expected", protocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+
+	return e, nil
+}
+
+// otlpResource returns resource attributes of the instance, following
+// OpenTelemetry semantic conventions
+func otlpResource(s *service) map[string]string {
+	attributes := map[string]string{
+		"service.name": otlpScopeName,
+		"host.name":    s.instanceName,
+	}
+
+	if Version != "" {
+		attributes["service.version"] = Version
+	}
+
+	if s.instanceID != "" {
+		attributes["cloud.provider"] = "gcp"
+		attributes["cloud.platform"] = "gcp_compute_engine"
+		attributes["cloud.account.id"] = s.projectID
+		attributes["cloud.availability_zone"] = s.zone
+		attributes["host.id"] = s.instanceID
+	}
+
+	return attributes
+}
+
+// Describe keeps units and descriptions of metrics, sent with their points
+func (e *otlpSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	for _, d := range descriptors {
+		e.descriptors[d.Type] = d
+	}
+
+	return nil
+}
+
+// Write sends points of a batch, they're dropped on failure
+func (e *otlpSink) Write(b *timeSeriesBatch) error {
+	metrics := e.metrics(b)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+
+	var err error
+	if e.protocol == otlpProtocolGRPC {
+		var reply otlpRawMessage
+		err = e.conn.Invoke(ctx, otlpExportMethod, otlpRawMessage(e.encodeProto(metrics)), &reply, grpc.ForceCodec(otlpRawCodec{}))
+	} else {
+		err = e.post(ctx, metrics)
+	}
+
+	if err != nil {
+		return fmt.Errorf("export of %d metrics failed: %s", len(metrics), err.Error())
+	}
+
+	return nil
+}
+
+// Flush does nothing, Write returns once points are sent
+func (e *otlpSink) Flush() error {
+	return nil
+}
+
+func (e *otlpSink) post(ctx context.Context, metrics []otlpMetric) error {
+	body, err := json.Marshal(e.encodeJSON(metrics))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func (e *otlpSink) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+
+	return nil
+}
+
+// metrics groups series of a batch by metric type, a metric type maps to a
+// gauge, a monotonic cumulative sum or a delta histogram for distributions
+func (e *otlpSink) metrics(b *timeSeriesBatch) []otlpMetric {
+	byType := map[string]*otlpMetric{}
+	var types []string
+
+	for _, ts := range b.series {
+		m, ok := byType[ts.metricType]
+		if !ok {
+			m = &otlpMetric{
+				name: otlpName(ts.metricType),
+				kind: otlpKindGauge,
+			}
+
+			if d, ok := e.descriptors[ts.metricType]; ok {
+				m.description = d.Description
+				m.unit = d.Unit
+			}
+
+			switch {
+			case ts.valueType == metric.MetricDescriptor_DISTRIBUTION:
+				m.kind = otlpKindHistogram
+				m.temporality = otlpTemporalityDelta
+			case ts.kind == metric.MetricDescriptor_CUMULATIVE:
+				m.kind = otlpKindSum
+				m.monotonic = true
+				m.temporality = otlpTemporalityCumulative
+			}
+
+			byType[ts.metricType] = m
+			types = append(types, ts.metricType)
+		}
+
+		m.points = append(m.points, otlpDataPoint(ts, m.kind))
+	}
+
+	sort.Strings(types)
+
+	metrics := make([]otlpMetric, 0, len(types))
+	for _, t := range types {
+		metrics = append(metrics, *byType[t])
+	}
+
+	return metrics
+}
+
+// otlpName returns the OpenTelemetry name of a metric type, made of its
+// path after the domain joined by dots, e.g. gpu.temperature_gpu
+func otlpName(metricType string) string {
+	path := metricType
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[i+1:]
+	}
+
+	return strings.Replace(path, "/", ".", -1)
+}
+
+func otlpDataPoint(ts *timeSeries, kind string) otlpPoint {
+	p := otlpPoint{
+		attributes: ts.labels,
+		start:      unixNano(ts.start),
+		end:        unixNano(ts.end),
+	}
+
+	switch ts.valueType {
+	case metric.MetricDescriptor_INT64, metric.MetricDescriptor_BOOL:
+		p.isInt, p.intValue = true, int64(ts.value)
+	case metric.MetricDescriptor_DOUBLE:
+		p.doubleValue = ts.value
+	case metric.MetricDescriptor_DISTRIBUTION:
+		h := ts.distribution
+		p.count = uint64(h.count)
+		p.sum = h.mean * float64(h.count)
+		p.bounds = h.upperBounds()
+		p.bucketCounts = otlpBucketCounts(h)
+
+		// a distribution covers the last metrics interval
+		p.start = p.end - uint64(time.Duration(flagFetchMetricsInterval)*time.Second)
+	}
+
+	if kind == otlpKindGauge {
+		p.start = 0
+	}
+
+	return p
+}
+
+// otlpBucketCounts returns counts of buckets including their upper bound,
+// as OTLP explicit bounds are
+func otlpBucketCounts(h *histogram) []uint64 {
+	upper := h.upperBucketCounts()
+
+	counts := make([]uint64, 0, len(upper))
+	for _, c := range upper {
+		counts = append(counts, uint64(c))
+	}
+
+	return counts
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint64(t.UnixNano())
+}
+
+// sortedKeys returns keys of attributes in order, so requests are stable
+func sortedKeys(attributes map[string]string) []string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// encodeJSON returns an ExportMetricsServiceRequest following the OTLP/JSON
+// mapping, 64 bits integers are encoded as strings
+func (e *otlpSink) encodeJSON(metrics []otlpMetric) map[string]interface{} {
+	attributes := func(attrs map[string]string) []interface{} {
+		out := make([]interface{}, 0, len(attrs))
+		for _, k := range sortedKeys(attrs) {
+			out = append(out, map[string]interface{}{
+				"key":   k,
+				"value": map[string]interface{}{"stringValue": attrs[k]},
+			})
+		}
+		return out
+	}
+
+	jsonMetrics := make([]interface{}, 0, len(metrics))
+	for _, m := range metrics {
+		points := make([]interface{}, 0, len(m.points))
+		for _, p := range m.points {
+			jp := map[string]interface{}{
+				"attributes":   attributes(p.attributes),
+				"timeUnixNano": fmt.Sprint(p.end),
+			}
+			if p.start != 0 {
+				jp["startTimeUnixNano"] = fmt.Sprint(p.start)
+			}
+
+			switch {
+			case m.kind == otlpKindHistogram:
+				counts := make([]string, 0, len(p.bucketCounts))
+				for _, c := range p.bucketCounts {
+					counts = append(counts, fmt.Sprint(c))
+				}
+				jp["count"] = fmt.Sprint(p.count)
+				jp["sum"] = p.sum
+				jp["bucketCounts"] = counts
+				jp["explicitBounds"] = p.bounds
+			case p.isInt:
+				jp["asInt"] = fmt.Sprint(p.intValue)
+			default:
+				jp["asDouble"] = p.doubleValue
+			}
+
+			points = append(points, jp)
+		}
+
+		data := map[string]interface{}{"dataPoints": points}
+		if m.temporality != 0 {
+			data["aggregationTemporality"] = m.temporality
+		}
+		if m.monotonic {
+			data["isMonotonic"] = true
+		}
+
+		jsonMetrics = append(jsonMetrics, map[string]interface{}{
+			"name":        m.name,
+			"description": m.description,
+			"unit":        m.unit,
+			m.kind:        data,
+		})
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(e.resource),
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]interface{}{"name": otlpScopeName, "version": Version},
+						"metrics": jsonMetrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// encodeProto returns an ExportMetricsServiceRequest in protobuf wire
+// format, field numbers are from opentelemetry-proto metrics v1
+func (e *otlpSink) encodeProto(metrics []otlpMetric) []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScopeName)
+	scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+	scope = protowire.AppendString(scope, Version)
+
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+	for _, m := range metrics {
+		scopeMetrics = appendMessage(scopeMetrics, 2, encodeProtoMetric(m))
+	}
+
+	var resource []byte
+	resource = appendAttributes(resource, 1, e.resource)
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+func encodeProtoMetric(m otlpMetric) []byte {
+	var data []byte
+	for _, p := range m.points {
+		if m.kind == otlpKindHistogram {
+			data = appendMessage(data, 1, encodeProtoHistogramPoint(p))
+		} else {
+			data = appendMessage(data, 1, encodeProtoNumberPoint(p))
+		}
+	}
+
+	if m.temporality != 0 {
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(m.temporality))
+	}
+
+	if m.monotonic {
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, protowire.EncodeBool(true))
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, m.description)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, m.unit)
+
+	switch m.kind {
+	case otlpKindSum:
+		b = appendMessage(b, 7, data)
+	case otlpKindHistogram:
+		b = appendMessage(b, 9, data)
+	default:
+		b = appendMessage(b, 5, data)
+	}
+
+	return b
+}
+
+func encodeProtoNumberPoint(p otlpPoint) []byte {
+	var b []byte
+	b = appendFixed64(b, 2, p.start)
+	b = appendFixed64(b, 3, p.end)
+
+	if p.isInt {
+		b = appendFixed64(b, 6, uint64(p.intValue))
+	} else {
+		b = appendFixed64(b, 4, math.Float64bits(p.doubleValue))
+	}
+
+	return appendAttributes(b, 7, p.attributes)
+}
+
+func encodeProtoHistogramPoint(p otlpPoint) []byte {
+	var b []byte
+	b = appendFixed64(b, 2, p.start)
+	b = appendFixed64(b, 3, p.end)
+	b = appendFixed64(b, 4, p.count)
+	b = appendFixed64(b, 5, math.Float64bits(p.sum))
+
+	var counts []byte
+	for _, c := range p.bucketCounts {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	b = appendMessage(b, 6, counts)
+
+	var bounds []byte
+	for _, v := range p.bounds {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(v))
+	}
+	b = appendMessage(b, 7, bounds)
+
+	return appendAttributes(b, 9, p.attributes)
+}
+
+// appendMessage appends an embedded message or a packed repeated field
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// appendAttributes appends attributes as repeated KeyValue with string values
+func appendAttributes(b []byte, num protowire.Number, attributes map[string]string) []byte {
+	for _, k := range sortedKeys(attributes) {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, attributes[k])
+
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kv = appendMessage(kv, 2, value)
+
+		b = appendMessage(b, num, kv)
+	}
+
+	return b
+}
+
+// otlpRawMessage is an already encoded protobuf message
+type otlpRawMessage []byte
+
+// otlpRawCodec passes otlpRawMessage through gRPC without generated types
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(otlpRawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+
+	return m, nil
+}
+
+func (otlpRawCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(*otlpRawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+
+	*m = append((*m)[:0], data...)
+
+	return nil
+}
+
+func (otlpRawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// wireField is a field of a protobuf message decoded without its type
+type wireField struct {
+	num   protowire.Number
+	bytes []byte
+	value uint64
+}
+
+func decodeWire(t *testing.T, b []byte) []wireField {
+	t.Helper()
+
+	var fields []wireField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %s", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		f := wireField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %s", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// wireFields returns fields num of a message
+func wireFields(t *testing.T, b []byte, num protowire.Number) []wireField {
+	t.Helper()
+
+	var found []wireField
+	for _, f := range decodeWire(t, b) {
+		if f.num == num {
+			found = append(found, f)
+		}
+	}
+
+	return found
+}
+
+// wireOne returns the single field num of a message
+func wireOne(t *testing.T, b []byte, num protowire.Number) wireField {
+	t.Helper()
+
+	found := wireFields(t, b, num)
+	if len(found) != 1 {
+		t.Fatalf("got %d fields %d, want 1", len(found), num)
+	}
+
+	return found[0]
+}
+
+// wireAttributes returns KeyValue fields num of a message as a map
+func wireAttributes(t *testing.T, b []byte, num protowire.Number) map[string]string {
+	t.Helper()
+
+	attributes := map[string]string{}
+	for _, kv := range wireFields(t, b, num) {
+		key := string(wireOne(t, kv.bytes, 1).bytes)
+		value := wireOne(t, kv.bytes, 2).bytes
+		attributes[key] = string(wireOne(t, value, 1).bytes)
+	}
+
+	return attributes
+}
+
+func testOTLPBatch() *timeSeriesBatch {
+	end := time.Unix(1600000000, 0)
+
+	b := &timeSeriesBatch{end: end}
+	b.add(&timeSeries{
+		metricType: "custom.googleapis.com/gpu/temperature_gpu",
+		kind:       metric.MetricDescriptor_GAUGE,
+		valueType:  metric.MetricDescriptor_INT64,
+		labels:     map[string]string{"gpu_id": "gpu_0"},
+		end:        end,
+		value:      50,
+	})
+	b.add(&timeSeries{
+		metricType: "custom.googleapis.com/gpu/energy",
+		kind:       metric.MetricDescriptor_CUMULATIVE,
+		valueType:  metric.MetricDescriptor_DOUBLE,
+		labels:     map[string]string{"gpu_id": "gpu_0"},
+		start:      end.Add(-time.Hour),
+		end:        end,
+		value:      12.5,
+	})
+	b.add(&timeSeries{
+		metricType: "custom.googleapis.com/gpu/utilization_gpu_distribution",
+		kind:       metric.MetricDescriptor_GAUGE,
+		valueType:  metric.MetricDescriptor_DISTRIBUTION,
+		labels:     map[string]string{"gpu_id": "gpu_0"},
+		end:        end,
+		// values on a bound belong to the bucket it closes
+		distribution: distributionValue([]float64{10, 20, 25}, &nvidiasmiQuery{Buckets: []float64{10, 20}}),
+	})
+
+	return b
+}
+
+func newTestOTLPSink(t *testing.T, protocol string, endpoint string) *otlpSink {
+	e, err := newOTLPSink(&service{instanceName: "test-vm"}, protocol, endpoint, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Describe([]*metric.MetricDescriptor{
+		{Type: "custom.googleapis.com/gpu/temperature_gpu", Unit: "Cel", Description: "GPU temperature"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// otlpStubCodec adapts otlpRawCodec to the codec of a gRPC server
+type otlpStubCodec struct {
+	otlpRawCodec
+}
+
+func (otlpStubCodec) String() string {
+	return otlpRawCodec{}.Name()
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, 1)
+
+	// the stub decodes requests with the same raw codec as the sink, set on
+	// the stub only so that the global proto codec is left untouched
+	server := grpc.NewServer(grpc.CustomCodec(otlpStubCodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Export",
+				Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+					var req otlpRawMessage
+					if err := dec(&req); err != nil {
+						return nil, err
+					}
+
+					received <- req
+
+					return otlpRawMessage{}, nil
+				},
+			},
+		},
+	}, struct{}{})
+
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	e := newTestOTLPSink(t, otlpProtocolGRPC, l.Addr().String())
+	defer e.Close()
+
+	if err := e.Write(testOTLPBatch()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-received
+
+	resourceMetrics := wireOne(t, req, 1).bytes
+
+	resource := wireOne(t, resourceMetrics, 1).bytes
+	if got := wireAttributes(t, resource, 1); got["host.name"] != "test-vm" || got["service.name"] != otlpScopeName {
+		t.Errorf("resource attributes = %v", got)
+	}
+
+	scopeMetrics := wireOne(t, resourceMetrics, 2).bytes
+	if got := string(wireOne(t, wireOne(t, scopeMetrics, 1).bytes, 1).bytes); got != otlpScopeName {
+		t.Errorf("scope name = %q, want %q", got, otlpScopeName)
+	}
+
+	// metrics are sorted by type
+	metrics := wireFields(t, scopeMetrics, 2)
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+
+	end := uint64(time.Unix(1600000000, 0).UnixNano())
+
+	// cumulative DOUBLE as monotonic cumulative sum
+	sum := metrics[0].bytes
+	if got := string(wireOne(t, sum, 1).bytes); got != "gpu.energy" {
+		t.Errorf("metric 0 name = %q, want gpu.energy", got)
+	}
+	data := wireOne(t, sum, 7).bytes
+	if got := wireOne(t, data, 2).value; got != otlpTemporalityCumulative {
+		t.Errorf("sum temporality = %d, want %d", got, otlpTemporalityCumulative)
+	}
+	if got := wireOne(t, data, 3).value; got != 1 {
+		t.Errorf("sum monotonic = %d, want 1", got)
+	}
+	point := wireOne(t, data, 1).bytes
+	if got := wireOne(t, point, 2).value; got != end-uint64(time.Hour) {
+		t.Errorf("sum start = %d, want %d", got, end-uint64(time.Hour))
+	}
+	if got := math.Float64frombits(wireOne(t, point, 4).value); got != 12.5 {
+		t.Errorf("sum value = %v, want 12.5", got)
+	}
+
+	// INT64 gauge with its unit and description
+	gauge := metrics[1].bytes
+	if got := string(wireOne(t, gauge, 1).bytes); got != "gpu.temperature_gpu" {
+		t.Errorf("metric 1 name = %q, want gpu.temperature_gpu", got)
+	}
+	if got := string(wireOne(t, gauge, 2).bytes); got != "GPU temperature" {
+		t.Errorf("gauge description = %q", got)
+	}
+	if got := string(wireOne(t, gauge, 3).bytes); got != "Cel" {
+		t.Errorf("gauge unit = %q, want Cel", got)
+	}
+	point = wireOne(t, wireOne(t, gauge, 5).bytes, 1).bytes
+	if got := wireOne(t, point, 3).value; got != end {
+		t.Errorf("gauge time = %d, want %d", got, end)
+	}
+	if got := int64(wireOne(t, point, 6).value); got != 50 {
+		t.Errorf("gauge value = %d, want 50", got)
+	}
+	if got := wireAttributes(t, point, 7); got["gpu_id"] != "gpu_0" {
+		t.Errorf("gauge attributes = %v", got)
+	}
+
+	// distribution as delta histogram
+	hist := metrics[2].bytes
+	data = wireOne(t, hist, 9).bytes
+	if got := wireOne(t, data, 2).value; got != otlpTemporalityDelta {
+		t.Errorf("histogram temporality = %d, want %d", got, otlpTemporalityDelta)
+	}
+	point = wireOne(t, data, 1).bytes
+	if got := wireOne(t, point, 4).value; got != 3 {
+		t.Errorf("histogram count = %d, want 3", got)
+	}
+	if got := math.Float64frombits(wireOne(t, point, 5).value); got != 55 {
+		t.Errorf("histogram sum = %v, want 55", got)
+	}
+
+	counts := wireOne(t, point, 6).bytes
+	for i, want := range []uint64{1, 1, 1} {
+		got, n := protowire.ConsumeFixed64(counts)
+		if n < 0 || got != want {
+			t.Errorf("histogram bucket %d = %d, want %d", i, got, want)
+		}
+		counts = counts[n:]
+	}
+
+	bounds := wireOne(t, point, 7).bytes
+	for i, want := range []float64{10, 20} {
+		got, n := protowire.ConsumeFixed64(bounds)
+		if n < 0 || math.Float64frombits(got) != want {
+			t.Errorf("histogram bound %d = %v, want %v", i, math.Float64frombits(got), want)
+		}
+		bounds = bounds[n:]
+	}
+
+	if got := wireAttributes(t, point, 9); got["gpu_id"] != "gpu_0" {
+		t.Errorf("histogram attributes = %v", got)
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpHTTPPath || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var req map[string]interface{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		received <- req
+	}))
+	defer server.Close()
+
+	e := newTestOTLPSink(t, otlpProtocolHTTP, server.URL)
+
+	if err := e.Write(testOTLPBatch()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-received
+
+	resourceMetrics := req["resourceMetrics"].([]interface{})[0].(map[string]interface{})
+	scopeMetrics := resourceMetrics["scopeMetrics"].([]interface{})[0].(map[string]interface{})
+	metrics := scopeMetrics["metrics"].([]interface{})
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+
+	gauge := metrics[1].(map[string]interface{})
+	if gauge["name"] != "gpu.temperature_gpu" || gauge["unit"] != "Cel" {
+		t.Errorf("gauge = %v", gauge)
+	}
+
+	point := gauge["gauge"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})
+	if point["asInt"] != "50" {
+		t.Errorf("gauge value = %v, want \"50\"", point["asInt"])
+	}
+
+	sum := metrics[0].(map[string]interface{})["sum"].(map[string]interface{})
+	if sum["isMonotonic"] != true || sum["aggregationTemporality"] != float64(otlpTemporalityCumulative) {
+		t.Errorf("sum = %v", sum)
+	}
+
+	hist := metrics[2].(map[string]interface{})["histogram"].(map[string]interface{})
+	hpoint := hist["dataPoints"].([]interface{})[0].(map[string]interface{})
+	if hpoint["count"] != "3" || hpoint["sum"] != float64(55) {
+		t.Errorf("histogram point = %v", hpoint)
+	}
+	if got := fmt.Sprint(hpoint["bucketCounts"]); got != "[1 1 1]" {
+		t.Errorf("histogram bucket counts = %s, want [1 1 1]", got)
+	}
+}
+
+func TestOTLPExportHTTPFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	e := newTestOTLPSink(t, otlpProtocolHTTP, server.URL)
+
+	if err := e.Write(testOTLPBatch()); err == nil {
+		t.Error("Write succeeded, want an error on HTTP 429")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+const (
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// prometheusStaleIntervals is the amount of metrics intervals after
+	// which a series which isn't published anymore is removed
+	prometheusStaleIntervals = 3
+)
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// prometheusSink serves the last point of every series in Prometheus
+// text exposition format
+type prometheusSink struct {
+	server *http.Server
+	mu     sync.Mutex
+	series map[string]prometheusSeries
+}
+
+type prometheusSeries struct {
+	name    string
+	ts      *timeSeries
+	updated time.Time
+	// histogram accumulates distributions of the series since it's
+	// served, Prometheus histograms are cumulative
+	histogram *prometheusHistogram
+}
+
+type prometheusHistogram struct {
+	bounds       []float64
+	bucketCounts []int64
+	count        int64
+	sum          float64
+}
+
+func newPrometheusSink() *prometheusSink {
+	return &prometheusSink{series: map[string]prometheusSeries{}}
+}
+
+// listen serves /metrics on address in background, it fails if the
+// address can't be listened
+func (p *prometheusSink) listen(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+
+	p.server = &http.Server{Handler: mux}
+
+	go func() {
+		_ = p.server.Serve(l)
+	}()
+
+	return nil
+}
+
+// Describe does nothing, metric types are known from written series
+func (p *prometheusSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	return nil
+}
+
+// Write stores points of a batch, replacing previous points of their series
+func (p *prometheusSink) Write(b *timeSeriesBatch) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ts := range b.series {
+		name := prometheusName(ts.metricType)
+		key := seriesKey(name, ts.labels)
+
+		s := prometheusSeries{
+			name:    name,
+			ts:      ts,
+			updated: b.end,
+		}
+
+		if ts.distribution != nil {
+			s.histogram = accumulateHistogram(p.series[key].histogram, ts.distribution)
+		}
+
+		p.series[key] = s
+	}
+
+	return nil
+}
+
+// Flush does nothing, points are served on scrape
+func (p *prometheusSink) Flush() error {
+	return nil
+}
+
+func (p *prometheusSink) Close() error {
+	return p.server.Close()
+}
+
+func (p *prometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	_, _ = w.Write([]byte(p.render(time.Now())))
+}
+
+// render returns series in text exposition format, grouped by metric name,
+// series of retired GPUs or exited processes are removed once stale
+func (p *prometheusSink) render(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stale := prometheusStaleIntervals * time.Duration(flagFetchMetricsInterval) * time.Second
+
+	families := map[string][]prometheusSeries{}
+	for k, s := range p.series {
+		if now.Sub(s.updated) > stale {
+			delete(p.series, k)
+			continue
+		}
+
+		families[s.name] = append(families[s.name], s)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		series := families[name]
+		sort.Slice(series, func(i, j int) bool {
+			return formatLabels(series[i].ts.labels, "", "") < formatLabels(series[j].ts.labels, "", "")
+		})
+
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, prometheusType(series[0]))
+		for _, s := range series {
+			writePrometheusSeries(&sb, s)
+		}
+	}
+
+	return sb.String()
+}
+
+// accumulateHistogram returns h added to previous counts, counts restart
+// from h if buckets changed, which Prometheus handles as a counter reset
+func accumulateHistogram(previous *prometheusHistogram, h *histogram) *prometheusHistogram {
+	bounds := h.upperBounds()
+	counts := h.upperBucketCounts()
+
+	acc := &prometheusHistogram{
+		bounds:       bounds,
+		bucketCounts: make([]int64, len(counts)),
+	}
+
+	if previous != nil && sameBounds(previous.bounds, bounds) && len(previous.bucketCounts) == len(counts) {
+		copy(acc.bucketCounts, previous.bucketCounts)
+		acc.count = previous.count
+		acc.sum = previous.sum
+	}
+
+	for i, c := range counts {
+		acc.bucketCounts[i] += c
+	}
+	acc.count += h.count
+	acc.sum += h.mean * float64(h.count)
+
+	return acc
+}
+
+func sameBounds(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prometheusName returns the Prometheus name of a metric type, made of
+// its path after the domain, e.g. gpu_temperature_gpu
+func prometheusName(metricType string) string {
+	path := metricType
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[i+1:]
+	}
+
+	return strings.Replace(path, "/", "_", -1)
+}
+
+func prometheusType(s prometheusSeries) string {
+	if s.ts.valueType == metric.MetricDescriptor_DISTRIBUTION {
+		return "histogram"
+	}
+
+	if s.ts.kind == metric.MetricDescriptor_CUMULATIVE {
+		return "counter"
+	}
+
+	return "gauge"
+}
+
+func writePrometheusSeries(sb *strings.Builder, s prometheusSeries) {
+	labels := s.ts.labels
+
+	switch s.ts.valueType {
+	case metric.MetricDescriptor_DOUBLE:
+		fmt.Fprintf(sb, "%s%s %s\n", s.name, formatLabels(labels, "", ""), formatFloat(s.ts.value))
+	case metric.MetricDescriptor_DISTRIBUTION:
+		h := s.histogram
+
+		var count int64
+		for i, c := range h.bucketCounts {
+			count += c
+
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = formatFloat(h.bounds[i])
+			}
+
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", s.name, formatLabels(labels, "le", le), count)
+		}
+
+		fmt.Fprintf(sb, "%s_sum%s %s\n", s.name, formatLabels(labels, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(sb, "%s_count%s %d\n", s.name, formatLabels(labels, "", ""), h.count)
+	default:
+		// INT64 and BOOL values are integers
+		fmt.Fprintf(sb, "%s%s %d\n", s.name, formatLabels(labels, "", ""), int64(s.ts.value))
+	}
+}
+
+// formatLabels returns sorted labels in exposition format, with an extra
+// label if extraKey isn't empty
+func formatLabels(labels map[string]string, extraKey string, extraValue string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pairs = append(pairs, k+`="`+labelValueEscaper.Replace(labels[k])+`"`)
+	}
+
+	if extraKey != "" {
+		pairs = append(pairs, extraKey+`="`+labelValueEscaper.Replace(extraValue)+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestPrometheusRenderHistogram(t *testing.T) {
+	p := newPrometheusSink()
+	q := &nvidiasmiQuery{Buckets: []float64{50, 100}}
+
+	// values on a bound belong to the le bucket of this bound, counts
+	// accumulate over written batches
+	for _, values := range [][]float64{{100, 100, 50}, {20, 120}} {
+		b := newTimeSeriesBatch()
+		b.add(&timeSeries{
+			metricType:   "custom.googleapis.com/gpu/utilization_gpu_distribution",
+			kind:         metric.MetricDescriptor_GAUGE,
+			valueType:    metric.MetricDescriptor_DISTRIBUTION,
+			labels:       map[string]string{"gpu_id": "gpu_0"},
+			end:          b.end,
+			distribution: distributionValue(values, q),
+		})
+
+		if err := p.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := strings.Join([]string{
+		"# TYPE gpu_utilization_gpu_distribution histogram",
+		`gpu_utilization_gpu_distribution_bucket{gpu_id="gpu_0",le="50"} 2`,
+		`gpu_utilization_gpu_distribution_bucket{gpu_id="gpu_0",le="100"} 4`,
+		`gpu_utilization_gpu_distribution_bucket{gpu_id="gpu_0",le="+Inf"} 5`,
+		`gpu_utilization_gpu_distribution_sum{gpu_id="gpu_0"} 390`,
+		`gpu_utilization_gpu_distribution_count{gpu_id="gpu_0"} 5`,
+		"",
+	}, "\n")
+
+	if got := p.render(time.Now()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramBucketCounts(t *testing.T) {
+	tests := []struct {
+		values []float64
+		bounds []float64
+		lower  []int64
+		upper  []int64
+	}{
+		{
+			values: []float64{100, 100, 50},
+			bounds: []float64{50, 100},
+			lower:  []int64{0, 1, 2},
+			upper:  []int64{1, 2, 0},
+		},
+		{
+			values: []float64{0, 1, 2, 3},
+			lower:  append([]int64{1, 1, 2}, make([]int64, defaultBucketsCount-1)...),
+			upper:  append([]int64{2, 1, 1}, make([]int64, defaultBucketsCount-1)...),
+		},
+	}
+
+	for _, tt := range tests {
+		h := distributionValue(tt.values, &nvidiasmiQuery{Buckets: tt.bounds})
+
+		if got := h.bucketCounts; !equalCounts(got, tt.lower) {
+			t.Errorf("%v in %v: bucket counts %v, want %v", tt.values, tt.bounds, got, tt.lower)
+		}
+
+		if got := h.upperBucketCounts(); !equalCounts(got, tt.upper) {
+			t.Errorf("%v in %v: upper bucket counts %v, want %v", tt.values, tt.bounds, got, tt.upper)
+		}
+	}
+}
+
+func equalCounts(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	queueFileExt = ".pb"
+
+	// maxPointAge is the oldest end time accepted by Cloud Monitoring
+	maxPointAge = 25 * time.Hour
+)
+
+// diskQueue stores series which couldn't be written in a directory, one
+// file per request named after the points end time, so they survive
+// restarts and are drained in timestamp order
+type diskQueue struct {
+	path    string
+	maxSize int64
+
+	mu    sync.Mutex
+	seq   int
+	files []queuedFile
+	size  int64
+}
+
+type queuedFile struct {
+	name string
+	size int64
+}
+
+// newDiskQueue opens the queue directory, creating it if needed,
+// and loads files left by a previous run
+func newDiskQueue(path string, maxSize int64) (*diskQueue, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{path: path, maxSize: maxSize}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), queueFileExt) {
+			continue
+		}
+
+		q.files = append(q.files, queuedFile{name: info.Name(), size: info.Size()})
+		q.size += info.Size()
+	}
+
+	// ReadDir sorts by name, i.e. by timestamp
+	return q, nil
+}
+
+func (q *diskQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.files) == 0
+}
+
+// push stores series ending at end, oldest files are dropped to stay
+// under the max size, it returns the amount of dropped files
+func (q *diskQueue) push(series []*monitoringpb.TimeSeries, end time.Time) (int, error) {
+	b, err := proto.Marshal(&monitoringpb.CreateTimeSeriesRequest{TimeSeries: series})
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d%s", end.UnixNano(), q.seq%1000000, queueFileExt)
+
+	if err := ioutil.WriteFile(filepath.Join(q.path, name), b, 0600); err != nil {
+		return 0, err
+	}
+
+	q.files = append(q.files, queuedFile{name: name, size: int64(len(b))})
+	q.size += int64(len(b))
+
+	sort.Slice(q.files, func(i, j int) bool {
+		return q.files[i].name < q.files[j].name
+	})
+
+	dropped := 0
+	for q.size > q.maxSize && len(q.files) > 1 {
+		q.removeLocked(q.files[0].name)
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// oldest returns the oldest file of the queue and its series,
+// name is empty if the queue is empty
+func (q *diskQueue) oldest() (string, []*monitoringpb.TimeSeries, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.files) == 0 {
+		return "", nil, nil
+	}
+
+	name := q.files[0].name
+
+	b, err := ioutil.ReadFile(filepath.Join(q.path, name))
+	if err != nil {
+		return name, nil, err
+	}
+
+	req := &monitoringpb.CreateTimeSeriesRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		return name, nil, err
+	}
+
+	return name, req.TimeSeries, nil
+}
+
+func (q *diskQueue) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.removeLocked(name)
+}
+
+func (q *diskQueue) removeLocked(name string) {
+	for i, f := range q.files {
+		if f.name != name {
+			continue
+		}
+
+		_ = os.Remove(filepath.Join(q.path, name))
+		q.files = append(q.files[:i], q.files[i+1:]...)
+		q.size -= f.size
+
+		return
+	}
+}
+
+// freshSeries returns series whose points are recent enough to be
+// accepted by Cloud Monitoring
+func freshSeries(series []*monitoringpb.TimeSeries, now time.Time) []*monitoringpb.TimeSeries {
+	fresh := make([]*monitoringpb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		if len(ts.Points) == 0 {
+			continue
+		}
+
+		end := ts.Points[0].Interval.GetEndTime().AsTime()
+		if now.Sub(end) < maxPointAge {
+			fresh = append(fresh, ts)
+		}
+	}
+
+	return fresh
+}
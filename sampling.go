@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+const (
+	// export modes of high frequency samples
+
+	exportModeSummary      = "summary"
+	exportModeDistribution = "distribution"
+
+	// maxBufferedSnapshots prevents unbounded memory usage if exports stall
+	maxBufferedSnapshots = 10000
+
+	// default exponential buckets cover values from 1 to ~1M
+	defaultBucketsCount  = 20
+	defaultBucketsGrowth = 2
+	defaultBucketsScale  = 1
+)
+
+var (
+	// summaryStats are exported on top of the mean in summary mode
+	summaryStats = []string{"max", "p50", "p95"}
+)
+
+// sampleBuffer holds snapshots sampled between two exports
+type sampleBuffer struct {
+	mu        sync.Mutex
+	snapshots [][]gpuSample
+}
+
+// add appends a snapshot, the oldest one is dropped if the buffer is full
+func (b *sampleBuffer) add(samples []gpuSample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.snapshots) >= maxBufferedSnapshots {
+		b.snapshots = b.snapshots[1:]
+	}
+
+	b.snapshots = append(b.snapshots, samples)
+}
+
+// drain returns and removes every buffered snapshot
+func (b *sampleBuffer) drain() [][]gpuSample {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshots := b.snapshots
+	b.snapshots = nil
+
+	return snapshots
+}
+
+// windowKey identifies values of a query for a GPU over an export interval
+type windowKey struct {
+	query string
+	busID string
+}
+
+// sampled returns true if the query is summarized over an export interval,
+// other queries use their last sampled value
+func (q *nvidiasmiQuery) sampled() bool {
+	return q.Kind == metric.MetricDescriptor_GAUGE &&
+		q.Type != metric.MetricDescriptor_BOOL &&
+		q.Parser != parserBitmask
+}
+
+// summaryQuery describes a summary statistic of a sampled query
+func (q *nvidiasmiQuery) summaryQuery(stat string) nvidiasmiQuery {
+	return nvidiasmiQuery{
+		Name:        q.Name + "." + stat,
+		DisplayName: q.DisplayName + " " + stat,
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        q.Type,
+		Unit:        q.Unit,
+	}
+}
+
+// distributionQuery describes the distribution of a sampled query
+func (q *nvidiasmiQuery) distributionQuery() nvidiasmiQuery {
+	return nvidiasmiQuery{
+		Name:        q.Name + ".distribution",
+		DisplayName: q.DisplayName + " distribution",
+		Kind:        metric.MetricDescriptor_GAUGE,
+		Type:        metric.MetricDescriptor_DISTRIBUTION,
+		Unit:        q.Unit,
+		Buckets:     q.Buckets,
+	}
+}
+
+// summarizeSnapshots merges snapshots into the last one where sampled
+// queries values are replaced by their mean, and returns values of each
+// sampled query for each GPU
+func summarizeSnapshots(snapshots [][]gpuSample, queries []nvidiasmiQuery) ([]gpuSample, map[windowKey][]float64) {
+	windows := make(map[windowKey][]float64)
+
+	for _, snapshot := range snapshots {
+		for _, sample := range snapshot {
+			for _, q := range queries {
+				if !q.sampled() {
+					continue
+				}
+
+				if v, ok := sample.Values[q.Name]; ok {
+					k := windowKey{query: q.Name, busID: sample.BusID}
+					windows[k] = append(windows[k], v)
+				}
+			}
+		}
+	}
+
+	last := snapshots[len(snapshots)-1]
+	samples := make([]gpuSample, 0, len(last))
+
+	for _, sample := range last {
+		merged := gpuSample{
+			ID:     sample.ID,
+			BusID:  sample.BusID,
+			Values: make(map[string]float64, len(sample.Values)),
+		}
+
+		for name, v := range sample.Values {
+			merged.Values[name] = v
+		}
+
+		for _, q := range queries {
+			if values, ok := windows[windowKey{query: q.Name, busID: sample.BusID}]; ok {
+				merged.Values[q.Name] = aggregate(aggregateMean, values)
+			}
+		}
+
+		samples = append(samples, merged)
+	}
+
+	return samples, windows
+}
+
+// summaryStat computes a summary statistic over values, values must not be empty
+func summaryStat(stat string, values []float64) float64 {
+	switch stat {
+	case "max":
+		return aggregate(aggregateMax, values)
+	case "p50":
+		return percentile(values, 0.5)
+	case "p95":
+		return percentile(values, 0.95)
+	default:
+		return 0
+	}
+}
+
+// percentile returns the nearest-rank percentile p (between 0 and 1) of values
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
+
+// distributionValue builds a histogram with query explicit buckets,
+// or default exponential buckets
+func distributionValue(values []float64, q *nvidiasmiQuery) *histogram {
+	h := &histogram{
+		count:  int64(len(values)),
+		bounds: q.Buckets,
+		values: values,
+	}
+
+	if len(values) > 0 {
+		h.mean = aggregate(aggregateMean, values)
+		for _, v := range values {
+			h.sumOfSquaredDeviation += (v - h.mean) * (v - h.mean)
+		}
+	}
+
+	// bucket 0 is the underflow bucket, the last one the overflow bucket
+	var bucket func(v float64) int
+
+	if len(q.Buckets) > 0 {
+		bounds := q.Buckets
+		h.bucketCounts = make([]int64, len(bounds)+1)
+		bucket = func(v float64) int {
+			return sort.Search(len(bounds), func(i int) bool { return v < bounds[i] })
+		}
+	} else {
+		h.bucketCounts = make([]int64, defaultBucketsCount+2)
+		bucket = func(v float64) int {
+			if v < defaultBucketsScale {
+				return 0
+			}
+
+			i := int(math.Floor(math.Log(v/defaultBucketsScale)/math.Log(defaultBucketsGrowth))) + 1
+			if i > defaultBucketsCount+1 {
+				i = defaultBucketsCount + 1
+			}
+
+			return i
+		}
+	}
+
+	for _, v := range values {
+		h.bucketCounts[bucket(v)]++
+	}
+
+	return h
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// timeSeriesBatch gathers points of a tick, they share the same end time
+// and are written together by sinks
+type timeSeriesBatch struct {
+	end    time.Time
+	series []*timeSeries
+}
+
+func newTimeSeriesBatch() *timeSeriesBatch {
+	return &timeSeriesBatch{end: time.Now()}
+}
+
+func (b *timeSeriesBatch) add(ts *timeSeries) {
+	b.series = append(b.series, ts)
+}
+
+// timeSeries is a point of a published metric, it doesn't depend on any
+// backend, each sink converts it to its own format
+type timeSeries struct {
+	metricType string
+	kind       metric.MetricDescriptor_MetricKind
+	valueType  metric.MetricDescriptor_ValueType
+	labels     map[string]string
+	// start is only set for cumulative metrics
+	start time.Time
+	end   time.Time
+	// value of INT64, DOUBLE and BOOL series, rounded for INT64
+	// series and 0 or 1 for BOOL series
+	value        float64
+	distribution *histogram
+}
+
+// histogram is a distribution of sampled values, bucket 0 is the
+// underflow bucket and the last one the overflow bucket
+type histogram struct {
+	count                 int64
+	mean                  float64
+	sumOfSquaredDeviation float64
+	// bucketCounts include their lower bound, as Cloud Monitoring expects
+	bucketCounts []int64
+	// bounds are explicit bucket bounds, default exponential
+	// buckets are used if empty
+	bounds []float64
+	// values are the sampled values, bucketed again by upperBucketCounts
+	values []float64
+}
+
+// upperBounds returns upper bounds of finite buckets, the underflow
+// bucket included
+func (h *histogram) upperBounds() []float64 {
+	if len(h.bounds) > 0 {
+		return h.bounds
+	}
+
+	bounds := make([]float64, 0, defaultBucketsCount+1)
+	for i := 0; i <= defaultBucketsCount; i++ {
+		bounds = append(bounds, defaultBucketsScale*math.Pow(defaultBucketsGrowth, float64(i)))
+	}
+
+	return bounds
+}
+
+// upperBucketCounts returns bucket counts where buckets include their
+// upper bound, as Prometheus le buckets and OTLP explicit bounds expect
+func (h *histogram) upperBucketCounts() []int64 {
+	bounds := h.upperBounds()
+
+	counts := make([]int64, len(bounds)+1)
+	for _, v := range h.values {
+		counts[sort.SearchFloat64s(bounds, v)]++
+	}
+
+	return counts
+}
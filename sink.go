@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"sync"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+)
+
+const (
+	// maxPendingBatches bounds batches waiting for a slow sink, newer
+	// batches are dropped for this sink only
+	maxPendingBatches = 32
+)
+
+// Sink is a backend metrics are exported to
+type Sink interface {
+	// Describe declares metrics of the catalog before any write
+	Describe(descriptors []*metric.MetricDescriptor) error
+	// Write exports points of a batch
+	Write(b *timeSeriesBatch) error
+	// Flush returns once pending writes are done
+	Flush() error
+	// Close releases resources of the sink
+	Close() error
+}
+
+// fanoutSink writes the same batches to several sinks, each sink has its
+// own worker so a failing or slow sink never blocks another
+type fanoutSink struct {
+	slog    *syslog.Writer
+	workers []*sinkWorker
+}
+
+type sinkWorker struct {
+	name    string
+	sink    Sink
+	batches chan *timeSeriesBatch
+	pending sync.WaitGroup
+}
+
+func newFanoutSink(slog *syslog.Writer) *fanoutSink {
+	return &fanoutSink{slog: slog}
+}
+
+// add starts a worker writing batches to sink, name is used in logs
+func (f *fanoutSink) add(name string, sink Sink) {
+	w := &sinkWorker{
+		name:    name,
+		sink:    sink,
+		batches: make(chan *timeSeriesBatch, maxPendingBatches),
+	}
+
+	go func() {
+		for b := range w.batches {
+			if err := w.sink.Write(b); err != nil {
+				_ = f.slog.Err(fmt.Sprintf("%s sink: %s", w.name, err.Error()))
+			}
+			w.pending.Done()
+		}
+	}()
+
+	f.workers = append(f.workers, w)
+}
+
+// Describe declares metrics to every sink, it fails only if no sink succeeded
+func (f *fanoutSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	var err error
+
+	failed := 0
+	for _, w := range f.workers {
+		if err = w.sink.Describe(descriptors); err != nil {
+			_ = f.slog.Err(fmt.Sprintf("%s sink: %s", w.name, err.Error()))
+			failed++
+		}
+	}
+
+	if failed > 0 && failed == len(f.workers) {
+		return errors.New("metrics couldn't be described to any sink")
+	}
+
+	return nil
+}
+
+// Write queues a batch for every sink without waiting for them
+func (f *fanoutSink) Write(b *timeSeriesBatch) error {
+	for _, w := range f.workers {
+		w.pending.Add(1)
+
+		select {
+		case w.batches <- b:
+		default:
+			w.pending.Done()
+			_ = f.slog.Warning(fmt.Sprintf("%s sink is behind, batch of %d series dropped", w.name, len(b.series)))
+		}
+	}
+
+	return nil
+}
+
+// Flush waits for queued batches of every sink, then flushes them
+func (f *fanoutSink) Flush() error {
+	var err error
+
+	for _, w := range f.workers {
+		w.pending.Wait()
+
+		if ferr := w.sink.Flush(); ferr != nil {
+			err = fmt.Errorf("%s sink: %s", w.name, ferr.Error())
+			_ = f.slog.Err(err.Error())
+		}
+	}
+
+	return err
+}
+
+// Close closes every sink, batches still queued are dropped
+func (f *fanoutSink) Close() error {
+	var err error
+
+	for _, w := range f.workers {
+		if cerr := w.sink.Close(); cerr != nil {
+			err = fmt.Errorf("%s sink: %s", w.name, cerr.Error())
+			_ = f.slog.Err(err.Error())
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	metric "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// stdoutSink prints every point as a JSON line instead of exporting it,
+// with the resource GCP monitoring would receive, see --dry-run
+type stdoutSink struct {
+	w        *bufio.Writer
+	resource *monitoredres.MonitoredResource
+}
+
+func newStdoutSink(w io.Writer, resource *monitoredres.MonitoredResource) *stdoutSink {
+	return &stdoutSink{w: bufio.NewWriter(w), resource: resource}
+}
+
+// Describe does nothing, no descriptor is created in dry run
+func (o *stdoutSink) Describe(descriptors []*metric.MetricDescriptor) error {
+	return nil
+}
+
+// Write prints points of a batch, one line per point
+func (o *stdoutSink) Write(b *timeSeriesBatch) error {
+	enc := json.NewEncoder(o.w)
+
+	for _, ts := range b.series {
+		line := map[string]interface{}{
+			"metric_type":     ts.metricType,
+			"metric_kind":     ts.kind.String(),
+			"labels":          ts.labels,
+			"resource_type":   o.resource.Type,
+			"resource_labels": o.resource.Labels,
+			"value":           stdoutValue(ts),
+			"timestamp":       ts.end.Format(time.RFC3339Nano),
+		}
+
+		if !ts.start.IsZero() {
+			line["start_time"] = ts.start.Format(time.RFC3339Nano)
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return o.w.Flush()
+}
+
+// Flush does nothing, Write flushes printed lines
+func (o *stdoutSink) Flush() error {
+	return nil
+}
+
+func (o *stdoutSink) Close() error {
+	return o.w.Flush()
+}
+
+// stdoutValue returns the JSON value of a point, distributions are
+// printed with their bucket bounds and counts
+func stdoutValue(ts *timeSeries) interface{} {
+	switch ts.valueType {
+	case metric.MetricDescriptor_DOUBLE:
+		// JSON has no NaN nor infinity
+		if math.IsNaN(ts.value) || math.IsInf(ts.value, 0) {
+			return formatFloat(ts.value)
+		}
+		return ts.value
+	case metric.MetricDescriptor_BOOL:
+		return ts.value != 0
+	case metric.MetricDescriptor_DISTRIBUTION:
+		h := ts.distribution
+		return map[string]interface{}{
+			"count":         h.count,
+			"mean":          h.mean,
+			"bounds":        h.upperBounds(),
+			"bucket_counts": h.bucketCounts,
+		}
+	}
+
+	return int64(ts.value)
+}
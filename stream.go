@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log/syslog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamMinBackoff = time.Second
+	streamMaxBackoff = time.Minute
+)
+
+// streamCollector is a Collector reading samples continuously from a single
+// long-running nvidia-smi -lms child, it falls back on per call
+// nvidia-smi collection while no fresh snapshot is available
+type streamCollector struct {
+	*nvidiasmiCollector
+
+	interval time.Duration
+	slog     *syslog.Writer
+	once     sync.Once
+
+	mu      sync.Mutex
+	samples []gpuSample
+	updated time.Time
+}
+
+func newStreamCollector(interval time.Duration, slog *syslog.Writer) *streamCollector {
+	return &streamCollector{
+		nvidiasmiCollector: &nvidiasmiCollector{},
+		interval:           interval,
+		slog:               slog,
+	}
+}
+
+// Collect returns the last streamed snapshot, the nvidia-smi child
+// is started on first call with the given queries
+func (c *streamCollector) Collect(queries []nvidiasmiQuery) ([]gpuSample, error) {
+	c.once.Do(func() {
+		go c.stream(queries)
+	})
+
+	c.mu.Lock()
+	samples, updated := c.samples, c.updated
+	c.mu.Unlock()
+
+	if samples == nil || time.Since(updated) > 2*c.interval {
+		return c.nvidiasmiCollector.Collect(queries)
+	}
+
+	return samples, nil
+}
+
+// stream runs nvidia-smi forever, restarting it with an exponential backoff
+func (c *streamCollector) stream(queries []nvidiasmiQuery) {
+	backoff := streamMinBackoff
+
+	for {
+		started := time.Now()
+
+		if err := c.run(queries); err != nil {
+			_ = c.slog.Err(fmt.Sprintf("nvidia-smi stream stopped - %s", err.Error()))
+		} else {
+			_ = c.slog.Err("nvidia-smi stream stopped")
+		}
+
+		// a child running for a while is considered healthy
+		if time.Since(started) > streamMaxBackoff {
+			backoff = streamMinBackoff
+		}
+
+		_ = c.slog.Info(fmt.Sprintf("Restart nvidia-smi stream in %s", backoff))
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// run starts a nvidia-smi child and parses its output until it exits
+func (c *streamCollector) run(queries []nvidiasmiQuery) error {
+	fields := queryFields(queries)
+	columns := fieldColumns(fields)
+
+	cmd := exec.Command(flagNvidiasmiPath,
+		"--query-gpu="+strings.Join(fields, ","),
+		"--format=csv,noheader,nounits",
+		"-lms", fmt.Sprint(c.interval.Milliseconds()),
+	)
+
+	o, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	_ = c.slog.Info("nvidia-smi stream started")
+
+	var loop streamLoop
+
+	sc := bufio.NewScanner(o)
+	for sc.Scan() {
+		r := csv.NewReader(strings.NewReader(sc.Text()))
+		r.TrimLeadingSpace = true
+
+		record, err := r.Read()
+		if err != nil {
+			_ = c.slog.Err(err.Error())
+			continue
+		}
+
+		sample, err := parseGPURecord(record, queries, columns)
+		if err != nil {
+			_ = c.slog.Err(err.Error())
+			continue
+		}
+
+		if samples := loop.add(sample); samples != nil {
+			c.publish(samples)
+		}
+	}
+
+	// the last loop printed before the child exited, unless already
+	// published, nvidia-smi prints each loop at once
+	if samples := loop.flush(); samples != nil {
+		c.publish(samples)
+	}
+
+	return cmd.Wait()
+}
+
+// streamLoop assembles GPU records printed by nvidia-smi -lms in loops
+type streamLoop struct {
+	batch     []gpuSample
+	published bool
+	// gpus is the GPU amount of the previous loop
+	gpus int
+}
+
+// add appends a record to the current loop and returns a snapshot to
+// publish, a loop is complete once it has as many GPUs as the previous
+// one, or else when the next loop starts
+func (l *streamLoop) add(sample gpuSample) []gpuSample {
+	var complete []gpuSample
+
+	// GPUs are printed by ascending index on each loop, a lower or
+	// equal index means a new loop started, whatever the GPU amount
+	if len(l.batch) > 0 && sample.ID <= l.batch[len(l.batch)-1].ID {
+		if !l.published {
+			complete = l.batch
+		}
+
+		l.gpus = len(l.batch)
+		l.batch = nil
+		l.published = false
+	}
+
+	l.batch = append(l.batch, sample)
+
+	// GPUs added meanwhile are published again with the whole loop
+	if l.gpus > 0 && len(l.batch) >= l.gpus {
+		complete = l.batch
+		l.published = true
+	}
+
+	return complete
+}
+
+// flush returns the current loop if it wasn't published yet
+func (l *streamLoop) flush() []gpuSample {
+	if l.published || len(l.batch) == 0 {
+		return nil
+	}
+
+	l.published = true
+
+	return l.batch
+}
+
+// publish replaces the last snapshot
+func (c *streamCollector) publish(samples []gpuSample) {
+	c.mu.Lock()
+	c.samples = samples
+	c.updated = time.Now()
+	c.mu.Unlock()
+}
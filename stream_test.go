@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStreamLoop(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []int
+		// want are GPU ids of snapshots published after each record
+		want [][]int
+	}{
+		{
+			name: "first loop published once the next one starts",
+			ids:  []int{0, 1, 0},
+			want: [][]int{nil, nil, {0, 1}},
+		},
+		{
+			name: "loop published on its last GPU",
+			ids:  []int{0, 1, 0, 1, 0, 1},
+			want: [][]int{nil, nil, {0, 1}, {0, 1}, nil, {0, 1}},
+		},
+		{
+			name: "single GPU",
+			ids:  []int{0, 0, 0},
+			want: [][]int{nil, {0}, {0}},
+		},
+		{
+			name: "GPU removed",
+			ids:  []int{0, 1, 0, 1, 0, 0},
+			want: [][]int{nil, nil, {0, 1}, {0, 1}, nil, {0}},
+		},
+		{
+			name: "GPU added",
+			ids:  []int{0, 1, 0, 1, 0, 1, 2, 0},
+			want: [][]int{nil, nil, {0, 1}, {0, 1}, nil, {0, 1}, {0, 1, 2}, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		var l streamLoop
+
+		for i, id := range tt.ids {
+			var got []int
+			for _, s := range l.add(gpuSample{ID: id}) {
+				got = append(got, s.ID)
+			}
+
+			if !reflect.DeepEqual(got, tt.want[i]) {
+				t.Errorf("%s: record %d published %v, want %v", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestStreamLoopFlush(t *testing.T) {
+	var l streamLoop
+
+	for _, id := range []int{0, 1, 0} {
+		l.add(gpuSample{ID: id})
+	}
+
+	// the last loop is published when the child exits
+	if got := l.flush(); len(got) != 1 {
+		t.Errorf("flush returned %d GPUs, want 1", len(got))
+	}
+
+	if got := l.flush(); got != nil {
+		t.Errorf("flush returned %d GPUs twice", len(got))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// xidSourceKmsg is the kernel ring buffer, only new messages are read
+	xidSourceKmsg = "/dev/kmsg"
+	// xidSourceJournal reads kernel messages from systemd journal
+	xidSourceJournal = "journal"
+	// xidSourceNone disables XID errors detection
+	xidSourceNone = "none"
+)
+
+var (
+	// e.g. NVRM: Xid (PCI:0000:00:04): 79, pid=1234, GPU has fallen off the bus.
+	xidRegexp = regexp.MustCompile(`NVRM: Xid \((?:PCI:)?([0-9a-fA-F]+:[0-9a-fA-F]+:[0-9a-fA-F]+)(?:\.[0-9a-fA-F]+)?\): (\d+)`)
+)
+
+// xidKey identifies a XID error counter
+type xidKey struct {
+	busID string
+	code  int
+}
+
+// xidWatcher counts NVIDIA XID errors found in the kernel log
+type xidWatcher struct {
+	source string
+	slog   *syslog.Writer
+
+	mu     sync.Mutex
+	counts map[xidKey]int64
+}
+
+func newXIDWatcher(source string, slog *syslog.Writer) *xidWatcher {
+	return &xidWatcher{
+		source: source,
+		slog:   slog,
+		counts: make(map[xidKey]int64),
+	}
+}
+
+// watch reads the source forever, it's meant to be run in a goroutine
+func (w *xidWatcher) watch() {
+	if w.source == xidSourceJournal {
+		w.watchJournal()
+		return
+	}
+
+	f, err := os.Open(w.source)
+	if err != nil {
+		_ = w.slog.Err(err.Error())
+		return
+	}
+	defer f.Close()
+
+	// only count XID errors happening from now
+	if w.source == xidSourceKmsg {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			_ = w.slog.Err(err.Error())
+			return
+		}
+	}
+
+	r := bufio.NewReader(f)
+
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			w.parseLine(line)
+		}
+
+		if err == io.EOF {
+			// follow the file like tail -f
+			time.Sleep(time.Second)
+		} else if err != nil && !errors.Is(err, syscall.EPIPE) {
+			// kmsg returns EPIPE when messages have been overwritten, others are fatal
+			_ = w.slog.Err(err.Error())
+			return
+		}
+	}
+}
+
+// watchJournal reads kernel messages from journalctl
+func (w *xidWatcher) watchJournal() {
+	cmd := exec.Command("journalctl", "--dmesg", "--follow", "--lines=0", "--output=cat")
+
+	o, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = w.slog.Err(err.Error())
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		_ = w.slog.Err(err.Error())
+		return
+	}
+
+	sc := bufio.NewScanner(o)
+	for sc.Scan() {
+		w.parseLine(sc.Text())
+	}
+
+	if err := cmd.Wait(); err != nil {
+		_ = w.slog.Err(err.Error())
+	}
+}
+
+// parseLine increments the related counter if line is a XID error
+func (w *xidWatcher) parseLine(line string) {
+	m := xidRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	code, err := strconv.Atoi(m[2])
+	if err != nil {
+		return
+	}
+
+	busID := normalizeBusID(m[1])
+
+	_ = w.slog.Warning(fmt.Sprintf("XID error %d detected on GPU %s", code, busID))
+
+	w.mu.Lock()
+	w.counts[xidKey{busID: busID, code: code}]++
+	w.mu.Unlock()
+}
+
+// snapshot returns a copy of every XID error counter
+func (w *xidWatcher) snapshot() map[xidKey]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	counts := make(map[xidKey]int64, len(w.counts))
+	for k, v := range w.counts {
+		counts[k] = v
+	}
+
+	return counts
+}
+
+// normalizeBusID converts nvidia-smi (00000000:00:04.0) and kernel (0000:00:04)
+// PCI bus ids into the same domain:bus:device form
+func normalizeBusID(busID string) string {
+	busID = strings.ToLower(strings.SplitN(busID, ".", 2)[0])
+
+	elems := strings.Split(busID, ":")
+	if len(elems) != 3 {
+		return busID
+	}
+
+	domain := elems[0]
+	if len(domain) > 4 {
+		domain = domain[len(domain)-4:]
+	}
+
+	return domain + ":" + elems[1] + ":" + elems[2]
+}
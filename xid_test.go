@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeBusID(t *testing.T) {
+	tests := []struct {
+		busID string
+		want  string
+	}{
+		{busID: "00000000:00:04.0", want: "0000:00:04"},
+		{busID: "0000:00:04", want: "0000:00:04"},
+		{busID: "0000:00:04.0", want: "0000:00:04"},
+		{busID: "00000000:3B:00.0", want: "0000:3b:00"},
+		{busID: "invalid", want: "invalid"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeBusID(tt.busID); got != tt.want {
+			t.Errorf("normalizeBusID(%q) = %q, want %q", tt.busID, got, tt.want)
+		}
+	}
+}
+
+func TestXIDParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[xidKey]int64
+	}{
+		{
+			line: "NVRM: Xid (PCI:0000:00:04): 79, pid=1234, GPU has fallen off the bus.",
+			want: map[xidKey]int64{{busID: "0000:00:04", code: 79}: 1},
+		},
+		{
+			line: "[  123.456] NVRM: Xid (0000:3B:00.0): 13, Graphics Exception",
+			want: map[xidKey]int64{{busID: "0000:3b:00", code: 13}: 1},
+		},
+		{
+			line: "nvidia-nvlink: Nvlink Core is being initialized, major device number 237",
+			want: map[xidKey]int64{},
+		},
+	}
+
+	for _, tt := range tests {
+		w := newXIDWatcher(xidSourceNone, newTestSyslog(t))
+		w.parseLine(tt.line)
+
+		if got := w.snapshot(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLine(%q) counted %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestXIDFixture(t *testing.T) {
+	f, err := os.Open(filepath.Join("hack", "fixtures", "kmsg.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := newXIDWatcher(xidSourceNone, newTestSyslog(t))
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w.parseLine(sc.Text())
+	}
+
+	want := map[xidKey]int64{
+		{busID: "0000:00:05", code: 48}: 1,
+		{busID: "0000:00:05", code: 63}: 1,
+		{busID: "0000:00:04", code: 79}: 1,
+	}
+
+	if got := w.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got XID errors %v, want %v", got, want)
+	}
+
+	// XID errors match GPUs of nvidia-smi fixtures once bus ids are normalized
+	samples, err := (&fakeCollector{fixturesPath: filepath.Join("hack", "fixtures")}).Collect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busIDs := map[string]bool{}
+	for _, s := range samples {
+		busIDs[normalizeBusID(s.BusID)] = true
+	}
+
+	for k := range want {
+		if !busIDs[k.busID] {
+			t.Errorf("XID error on %s matches no GPU of query-gpu.csv", k.busID)
+		}
+	}
+}